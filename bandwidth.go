@@ -0,0 +1,149 @@
+package gouxp
+
+const (
+	// bucket burst is 200ms of rate
+	bandwidthBurstDivisor = 5
+	// pacing bucket burst is 20ms of rate
+	pacingBurstDivisor = 50
+	// server rebalance fair share of aggregate limit
+	bandwidthRebalanceInterval = 200
+	// conn is active if it sends or receives in this period
+	bandwidthActiveTimeout = 1000
+	// idle connections share 1/10 of aggregate limit when some connections are active
+	bandwidthIdleShareDivisor = 10
+)
+
+// split aggregate limit between active and idle connections, the sum never exceeds limit.
+// idle connections get a small floor so they can start sending before next rebalance
+func bandwidthShares(limit, active, idle int) (activeShare int, idleShare int) {
+	if limit <= 0 {
+		return 0, 0
+	}
+
+	// nobody is active, idle connections share the whole limit
+	if active == 0 {
+		if idle == 0 {
+			return limit, limit
+		}
+
+		idleShare = limit / idle
+		if idleShare < 1 {
+			idleShare = 1
+		}
+
+		return limit, idleShare
+	}
+
+	if idle > 0 {
+		idleShare = limit / bandwidthIdleShareDivisor / idle
+		if idleShare < 1 {
+			idleShare = 1
+		}
+	}
+
+	activeShare = (limit - idleShare*idle) / active
+	if activeShare < 1 {
+		activeShare = 1
+	}
+
+	return
+}
+
+func newBandwidthBucket(rate int, now uint32) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return NewTokenBucket(rate, rate/bandwidthBurstDivisor, now)
+}
+
+func resetBandwidthBucket(b **TokenBucket, rate int, now uint32) {
+	if rate <= 0 {
+		*b = nil
+		return
+	}
+
+	if *b == nil {
+		*b = newBandwidthBucket(rate, now)
+		return
+	}
+
+	(*b).SetRate(rate, rate/bandwidthBurstDivisor, now)
+}
+
+// upload and download limit of conn, share buckets are set by server to divide
+// aggregate limit between active connections, pacing bucket is set by congestion controller
+type connBandwidth struct {
+	upload        *TokenBucket
+	download      *TokenBucket
+	uploadShare   *TokenBucket
+	downloadShare *TokenBucket
+	pacing        *TokenBucket
+	pending       [][]byte
+	pendingBytes  int
+	lastActive    uint32
+}
+
+func (bw *connBandwidth) uploadLimited() bool {
+	return bw.upload != nil || bw.uploadShare != nil || bw.pacing != nil
+}
+
+func allowAll(n int, now uint32, buckets ...*TokenBucket) bool {
+	for _, b := range buckets {
+		if b != nil && !b.Allow(n, now) {
+			return false
+		}
+	}
+
+	for _, b := range buckets {
+		if b != nil {
+			b.Take(n, now)
+		}
+	}
+
+	return true
+}
+
+func (bw *connBandwidth) allowUpload(n int, now uint32) bool {
+	bw.lastActive = now
+	return allowAll(n, now, bw.upload, bw.uploadShare, bw.pacing)
+}
+
+func (bw *connBandwidth) allowDownload(n int, now uint32) bool {
+	bw.lastActive = now
+	return allowAll(n, now, bw.download, bw.downloadShare)
+}
+
+// how long(ms) the first pending packet need to wait
+func (bw *connBandwidth) uploadDelay(now uint32) uint32 {
+	if len(bw.pending) == 0 {
+		return 0
+	}
+
+	n := len(bw.pending[0])
+	var delay uint32
+	for _, b := range []*TokenBucket{bw.upload, bw.uploadShare, bw.pacing} {
+		if b == nil {
+			continue
+		}
+
+		if d := b.Delay(n, now); d > delay {
+			delay = d
+		}
+	}
+
+	return delay
+}
+
+func (bw *connBandwidth) push(data []byte) {
+	buffer := make([]byte, len(data))
+	copy(buffer, data)
+	bw.pending = append(bw.pending, buffer)
+	bw.pendingBytes += len(buffer)
+}
+
+func (bw *connBandwidth) pop() {
+	bw.pendingBytes -= len(bw.pending[0])
+	bw.pending[0] = nil
+	bw.pending = bw.pending[1:]
+}
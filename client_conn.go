@@ -1,26 +1,35 @@
 package gouxp
 
 import (
+	"crypto/ed25519"
+	"crypto/hmac"
 	"encoding/binary"
 	"errors"
 	"runtime"
 	"sync/atomic"
 	"time"
 
-	"github.com/shaoyuan1943/gouxp/dh64"
-
 	"github.com/shaoyuan1943/gokcp"
 )
 
-type CryptoKeys struct {
-	privateKey uint64
-	publicKey  uint64
-}
-
 type ClientConn struct {
 	RawConn
-	convID     uint32
-	cryptoKeys CryptoKeys
+	convID        uint32
+	keyExchange   *x25519KeyExchange
+	handshakeData []byte
+	pskID         uint32
+	psk           []byte
+	trustedKeys   []ed25519.PublicKey
+	clientKey     ed25519.PrivateKey
+	cryptoTypes   []CryptoType
+	noisePattern  noisePattern
+	noiseKey      []byte
+	// NK: server static key, XX: trusted server static keys
+	noiseServerKeys [][]byte
+	noise           *noiseHandshake
+	// XX handshake result waiting for server to accept client static key
+	noisePending *pendingNoise
+	dicts        compressionDicts
 }
 
 func (conn *ClientConn) close(err error) {
@@ -42,34 +51,252 @@ func (conn *ClientConn) onHeartbeat(data []byte) error {
 }
 
 func (conn *ClientConn) onHandshake(data []byte) error {
-	// 1. exchange public key
-	if conn.cryptoCodec != nil {
-		serverPublicKey := binary.LittleEndian.Uint64(data)
-		num := dh64.Secret(conn.cryptoKeys.privateKey, serverPublicKey)
-		var nonce [8]byte
-		binary.LittleEndian.PutUint64(nonce[:], num)
-		conn.cryptoCodec.SetReadNonce(nonce[:])
-		conn.cryptoCodec.SetWriteNonce(nonce[:])
+	rsp, err := parseServerHello(data)
+	if err != nil {
+		return err
+	}
+
+	if rsp.status == handshakeStatusAuthFailed {
+		return ErrClientAuthFailed
+	}
+
+	if rsp.status != handshakeStatusAccepted || !containsCryptoType(conn.cryptoTypes, rsp.cryptoType) {
+		return ErrCryptoNegotiationFailed
+	}
+
+	if rsp.dictID != 0 && conn.dicts.get(rsp.dictID) == nil {
+		return ErrInvalidCompressionDict
+	}
+
+	rsp.fec = conn.checkFECConfig(rsp.fec, rsp.bufferLen)
+	// 1. verify server identity
+	if len(conn.trustedKeys) > 0 {
+		err = verifyIdentity(conn.trustedKeys, conn.handshakeData, data[:serverHelloSignedSize], rsp.signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 2. exchange public key, check key confirmation, install chosen codec
+	keys, err := conn.confirmSessionKeys(rsp, data)
+	if err != nil {
+		return err
+	}
+
+	var writeKeys, readKeys keyGeneration
+	if rsp.cryptoType != UseNoCrypto {
+		writeKeys = keyGeneration{key: keys.clientKey, nonce: keys.clientNonce}
+		readKeys = keyGeneration{key: keys.serverKey, nonce: keys.serverNonce}
+	}
+
+	return conn.establish(rsp.cryptoType, rsp.dictID, rsp.fec, rsp.bufferLen, writeKeys, readKeys)
+}
+
+// session keys from handshake, server MUST see the same handshake data as client
+func (conn *ClientConn) confirmSessionKeys(rsp *serverHello, data []byte) (*sessionKeys, error) {
+	secret, err := conn.keyExchange.Secret(rsp.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := deriveSessionKeys(secret, handshakeTranscript(conn.handshakeData, data))
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(keys.confirm, rsp.confirm) {
+		return nil, ErrHandshakeConfirmFailed
+	}
+
+	return keys, nil
+}
+
+func (conn *ClientConn) onNoiseHandshake(data []byte) error {
+	pattern, index, message, err := parseNoiseMessage(data)
+	if err != nil {
+		return err
+	}
+
+	if conn.noise == nil || pattern != conn.noisePattern {
+		return ErrNoiseHandshakeFailed
+	}
+
+	if index == noiseStatusIndex {
+		return conn.onNoiseStatus(message)
+	}
+
+	if index != 1 {
+		return ErrNoiseHandshakeFailed
+	}
+
+	payload, err := conn.noise.readMessage(message)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) < noiseServerPayload {
+		return ErrNoiseHandshakeFailed
+	}
+
+	status, cryptoType, dictID := payload[0], CryptoType(payload[1]), binary.LittleEndian.Uint32(payload[2:])
+	fec, err := parseFECConfig(payload[6:])
+	if err != nil {
+		return ErrNoiseHandshakeFailed
+	}
+
+	remoteBufferLen, err := parseBufferLen(payload[6+fecConfigSize:])
+	if err != nil {
+		return ErrNoiseHandshakeFailed
+	}
+
+	if status == handshakeStatusAuthFailed {
+		return ErrClientAuthFailed
+	}
+
+	if status != handshakeStatusAccepted || !containsCryptoType(conn.cryptoTypes, cryptoType) {
+		return ErrCryptoNegotiationFailed
+	}
+
+	if dictID != 0 && conn.dicts.get(dictID) == nil {
+		return ErrInvalidCompressionDict
+	}
+
+	fec = conn.checkFECConfig(fec, remoteBufferLen)
+	// 1. verify server static key and send client static key
+	if pattern == noiseXX {
+		if len(conn.noiseServerKeys) > 0 && !containsNoiseKey(conn.noiseServerKeys, conn.noise.rs) {
+			return ErrServerAuthFailed
+		}
+
+		message, err = conn.noise.writeMessage(nil)
+		if err != nil {
+			return err
+		}
+
+		err = conn.writeHandshake(protoTypeNoiseHandshake, noiseMessage(pattern, 2, message))
+		if err != nil {
+			return err
+		}
+
+		// server checks client static key, establish after it is accepted
+		conn.noisePending = &pendingNoise{hs: conn.noise, cryptoType: cryptoType, dictID: dictID, fec: fec, bufferLen: remoteBufferLen}
+		return nil
+	}
+
+	return conn.establishNoise(&pendingNoise{hs: conn.noise, cryptoType: cryptoType, dictID: dictID, fec: fec, bufferLen: remoteBufferLen})
+}
+
+// result of XX handshake
+func (conn *ClientConn) onNoiseStatus(message []byte) error {
+	pending := conn.noisePending
+	if pending == nil {
+		return ErrNoiseHandshakeFailed
+	}
+
+	status, err := pending.hs.readStatus(message)
+	if err != nil {
+		return err
 	}
 
-	// 2. init data buffer
+	conn.noisePending = nil
+	if status == handshakeStatusAuthFailed {
+		return ErrClientAuthFailed
+	}
+
+	if status != handshakeStatusAccepted {
+		return ErrNoiseHandshakeFailed
+	}
+
+	return conn.establishNoise(pending)
+}
+
+// 2. install chosen codec
+func (conn *ClientConn) establishNoise(pending *pendingNoise) error {
+	var writeKeys, readKeys keyGeneration
+	if pending.cryptoType != UseNoCrypto {
+		keys, err := pending.hs.sessionKeys()
+		if err != nil {
+			return err
+		}
+
+		writeKeys = keyGeneration{key: keys.clientKey, nonce: keys.clientNonce}
+		readKeys = keyGeneration{key: keys.serverKey, nonce: keys.serverNonce}
+	}
+
+	return conn.establish(pending.cryptoType, pending.dictID, pending.fec, pending.bufferLen, writeKeys, readKeys)
+}
+
+// FEC chosen by server MUST fit both read buffers, it's checked as server does. FEC which
+// doesn't fit isn't used instead of failing handshake
+func (conn *ClientConn) checkFECConfig(fec fecConfig, remoteBufferLen int) fecConfig {
+	if fec.dataShards == 0 {
+		return fec
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	err := checkFECConfig(fec.dataShards, fec.parityShards, fecHandshakeMTU(int(conn.kcp.MTU())),
+		fecBufferLen(conn.bufferLen, remoteBufferLen))
+	if err != nil {
+		if logger != nil {
+			logger.Warnf("fec config %v from server doesn't fit read buffer, fec is disabled", fec)
+		}
+
+		return fecConfig{}
+	}
+
+	return fec
+}
+
+// handshake is done, install session codecs and start conn
+func (conn *ClientConn) establish(cryptoType CryptoType, dictID uint32, fec fecConfig, remoteBufferLen int, writeKeys, readKeys keyGeneration) error {
+	conn.Lock()
+	conn.remoteBufferLen = remoteBufferLen
+	conn.installSessionCodecs(cryptoType, writeKeys, readKeys, gokcp.SetupFromNowMS())
+	conn.compressionDictID, conn.compressionDict = dictID, conn.dicts.get(dictID)
+	if fec.dataShards > 0 {
+		conn.enableFEC(fec)
+	} else {
+		conn.fecConfig = fec
+	}
+	conn.Unlock()
+
+	// 3. init data buffer
+	conn.Lock()
 	conn.buffer = make([]byte, conn.bufferLen)
+	conn.reconfigurer.established = true
+	conn.Unlock()
 
-	// 3. client handler callback
+	// 4. client handler callback
 	conn.handler.OnReady()
 
-	// 4. send first heartbeat
+	// 5. send first heartbeat
 	err := conn.heartbeat()
 	if err != nil {
 		return err
 	}
 
-	// 5. update KCP
+	// 6. update KCP
 	go conn.update()
 
 	return nil
 }
 
+// handshake packet: | key ID | PSK encrypted packet |
+func (conn *ClientConn) writeHandshake(protoType ProtoType, data []byte) error {
+	cipherData, err := conn.encrypt(handshakePacket(protoType, data))
+	if err != nil {
+		return err
+	}
+
+	var keyID [handshakeKeyIDSize]byte
+	putHandshakeKeyID(keyID[:], conn.pskID)
+	packet := append(keyID[:], cipherData...)
+	_, err = conn.rwc.WriteTo(packet, conn.addr)
+	return err
+}
+
 func (conn *ClientConn) update() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -113,12 +340,44 @@ func (conn *ClientConn) update() {
 			return recvErr
 		}
 
-		updateErr := conn.kcp.Update()
+		now := gokcp.SetupFromNowMS()
+		conn.updateCongestion(now)
+		updateErr := conn.updateMTUProbe(now)
 		if updateErr != nil {
 			return updateErr
 		}
 
-		return nil
+		updateErr = conn.updateReconfig(now)
+		if updateErr != nil {
+			return updateErr
+		}
+
+		updateErr = conn.updateRekey(now)
+		if updateErr != nil {
+			return updateErr
+		}
+
+		updateErr = conn.updateFECReport(now)
+		if updateErr != nil {
+			return updateErr
+		}
+
+		updateErr = conn.updateFECFlush(now)
+		if updateErr != nil {
+			return updateErr
+		}
+
+		updateErr = conn.kcp.Update()
+		if updateErr != nil {
+			return updateErr
+		}
+
+		updateErr = conn.checkDeadLink()
+		if updateErr != nil {
+			return updateErr
+		}
+
+		return conn.flushPending()
 	}
 
 	if conn.IsClosed() {
@@ -152,18 +411,34 @@ func (conn *ClientConn) onRecvRawData(data []byte) {
 	parseData := func(targetData []byte) error {
 		plaintextData, parseErr := conn.decrypt(targetData)
 		if parseErr != nil {
+			// duplicated packet from network, drop it
+			if parseErr == ErrReplayedPacket {
+				return nil
+			}
+
 			return parseErr
 		}
 
 		protoType := PlaintextData(plaintextData).Type()
-		logicData := PlaintextData(plaintextData).Data()
+		logicData, parseErr := conn.decompress(PlaintextData(plaintextData))
+		if parseErr != nil {
+			return parseErr
+		}
 		switch protoType {
 		case protoTypeHandshake:
 			parseErr = conn.onHandshake(logicData)
+		case protoTypeNoiseHandshake:
+			parseErr = conn.onNoiseHandshake(logicData)
 		case protoTypeHeartbeat:
 			parseErr = conn.onHeartbeat(logicData)
 		case protoTypeData:
 			parseErr = conn.onKCPDataInput(logicData)
+		case protoTypeMTUProbe:
+			parseErr = conn.onMTUProbe(logicData)
+		case protoTypeMTUProbeACK:
+			parseErr = conn.onMTUProbeACK(logicData)
+		case protoTypeControl:
+			parseErr = conn.onControl(logicData)
 		default:
 			parseErr = ErrUnknownProtocolType
 		}
@@ -232,7 +507,7 @@ func (conn *ClientConn) readRawDataLoop() {
 			}
 
 			atomic.StoreUint32(&conn.lastActiveTime, gokcp.SetupFromNowMS())
-			if n > 0 {
+			if n > 0 && conn.allowRecv(n) {
 				conn.onRecvRawData(buffer[:n])
 			}
 		}
@@ -241,7 +516,7 @@ func (conn *ClientConn) readRawDataLoop() {
 
 func (conn *ClientConn) heartbeat() error {
 	var heartbeatBuffer [heartbeatBufferSize]byte
-	binary.LittleEndian.PutUint16(heartbeatBuffer[macSize:], uint16(protoTypeHeartbeat))
+	binary.LittleEndian.PutUint16(heartbeatBuffer[protoOffset:], uint16(protoTypeHeartbeat))
 	binary.LittleEndian.PutUint32(heartbeatBuffer[PacketHeaderSize:], gokcp.SetupFromNowMS())
 
 	conn.Lock()
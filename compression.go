@@ -0,0 +1,313 @@
+package gouxp
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// KCP data is compressed before crypto, compression type is the high byte of PROTO.
+// data which doesn't get smaller is sent as it is with NoCompression,
+// receiver decompresses by type in packet, so each side chooses its own compression
+type CompressionType byte
+
+const (
+	NoCompression CompressionType = 0x00
+	UseSnappy     CompressionType = 0x01
+	UseZstd       CompressionType = 0x02
+	// zstd with dictionary agreed in handshake
+	UseZstdDict CompressionType = 0x03
+)
+
+// packet can't be larger than UDP datagram
+const maxDecompressedSize = 64 * 1024
+
+const (
+	maxHandshakeDicts = 16
+	dictHashBytes     = 6
+)
+
+type Compressor interface {
+	// result is valid until next call
+	Compress(src []byte) ([]byte, error)
+	// result is valid until next call, fails if it is larger than maxSize
+	Decompress(src []byte, maxSize int) ([]byte, error)
+}
+
+// factory returns a new compressor, every connection direction uses its own instance
+type CompressorFactory func() (Compressor, error)
+
+var compressors = struct {
+	sync.RWMutex
+	factories map[CompressionType]CompressorFactory
+}{
+	factories: map[CompressionType]CompressorFactory{
+		UseSnappy: func() (Compressor, error) { return &snappyCompressor{}, nil },
+		UseZstd:   func() (Compressor, error) { return newZstdCompressor(nil) },
+		// dictionary is per connection, see newCompressor
+		UseZstdDict: func() (Compressor, error) { return nil, ErrNoCompressionDict },
+	},
+}
+
+// both sides MUST register same compressor with same type
+func RegisterCompressor(tp CompressionType, factory CompressorFactory) error {
+	if tp == NoCompression || factory == nil {
+		return ErrInvalidCompression
+	}
+
+	compressors.Lock()
+	defer compressors.Unlock()
+
+	if _, ok := compressors.factories[tp]; ok {
+		return ErrCompressionRegistered
+	}
+
+	compressors.factories[tp] = factory
+	return nil
+}
+
+func createCompressor(tp CompressionType) (Compressor, error) {
+	compressors.RLock()
+	factory, ok := compressors.factories[tp]
+	compressors.RUnlock()
+
+	if !ok {
+		return nil, ErrInvalidCompression
+	}
+
+	return factory()
+}
+
+// dictionary compressor uses dictionary agreed in handshake
+func newCompressor(tp CompressionType, dict []byte) (Compressor, error) {
+	if tp != UseZstdDict {
+		return createCompressor(tp)
+	}
+
+	if dict == nil {
+		return nil, ErrNoCompressionDict
+	}
+
+	return newZstdCompressor(dict)
+}
+
+// zstd dictionaries by ID, in preference order
+type compressionDicts struct {
+	ids   []uint32
+	dicts map[uint32][]byte
+}
+
+// ID is read from dictionary, same ID replaces old dictionary.
+// copy on write, handshake reads a copy of compressionDicts without lock
+func (d *compressionDicts) add(data []byte) error {
+	id, err := compressionDictID(data)
+	if err != nil {
+		return err
+	}
+
+	ids := d.ids
+	if _, ok := d.dicts[id]; !ok {
+		if len(d.ids) >= maxHandshakeDicts {
+			return ErrInvalidCompressionDict
+		}
+
+		ids = append(append([]uint32(nil), d.ids...), id)
+	}
+
+	dicts := make(map[uint32][]byte, len(ids))
+	for k, v := range d.dicts {
+		dicts[k] = v
+	}
+
+	dicts[id] = append([]byte(nil), data...)
+	d.ids, d.dicts = ids, dicts
+	return nil
+}
+
+func (d *compressionDicts) get(id uint32) []byte {
+	return d.dicts[id]
+}
+
+// first of local dictionaries which remote has, 0 if none
+func (d *compressionDicts) choose(remoteIDs []uint32) uint32 {
+	for _, id := range d.ids {
+		for _, v := range remoteIDs {
+			if v == id {
+				return id
+			}
+		}
+	}
+
+	return 0
+}
+
+func compressionDictID(data []byte) (uint32, error) {
+	d, err := zstd.InspectDictionary(data)
+	if err != nil || d.ID() == 0 {
+		return 0, ErrInvalidCompressionDict
+	}
+
+	return d.ID(), nil
+}
+
+// train zstd dictionary from payload samples, id MUST NOT be 0, maxSize is dictionary size limit.
+// samples should be real payloads, dictionary is useless for data unlike them
+func TrainCompressionDict(id uint32, samples [][]byte, maxSize int) (data []byte, err error) {
+	if id == 0 || len(samples) == 0 || maxSize <= 0 {
+		return nil, ErrInvalidCompressionDict
+	}
+
+	// builder panics when samples have nothing in common
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, ErrInvalidCompressionDict
+		}
+	}()
+
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   dictHashBytes,
+		ZstdDictID:  id,
+		ZstdLevel:   zstd.SpeedFastest,
+	})
+}
+
+type snappyCompressor struct {
+	buffer []byte
+}
+
+func (c *snappyCompressor) Compress(src []byte) ([]byte, error) {
+	if n := snappy.MaxEncodedLen(len(src)); cap(c.buffer) < n {
+		c.buffer = make([]byte, n)
+	}
+
+	return snappy.Encode(c.buffer[:cap(c.buffer)], src), nil
+}
+
+func (c *snappyCompressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxSize {
+		return nil, ErrDecompressedTooLong
+	}
+
+	if cap(c.buffer) < n {
+		c.buffer = make([]byte, n)
+	}
+
+	return snappy.Decode(c.buffer[:n], src)
+}
+
+// fastest level and lower memory, packets are compressed one by one.
+// dictionary is optional, both sides MUST use the same one
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	buffer  []byte
+}
+
+func newZstdCompressor(dict []byte) (*zstdCompressor, error) {
+	encoderOptions := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithLowerEncoderMem(true),
+		zstd.WithEncoderCRC(false),
+	}
+
+	decoderOptions := []zstd.DOption{
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(maxDecompressedSize),
+	}
+
+	if dict != nil {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderDict(dict))
+		decoderOptions = append(decoderOptions, zstd.WithDecoderDicts(dict))
+	}
+
+	encoder, err := zstd.NewWriter(nil, encoderOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil, decoderOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdCompressor{encoder: encoder, decoder: decoder}, nil
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	c.buffer = c.encoder.EncodeAll(src, c.buffer[:0])
+	return c.buffer, nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	var header zstd.Header
+	err := header.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.HasFCS && header.FrameContentSize > uint64(maxSize) {
+		return nil, ErrDecompressedTooLong
+	}
+
+	c.buffer, err = c.decoder.DecodeAll(src, c.buffer[:0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.buffer) > maxSize {
+		return nil, ErrDecompressedTooLong
+	}
+
+	return c.buffer, nil
+}
+
+// compress KCP data in place and set PROTO, conn is locked
+func (conn *RawConn) compress(data []byte) []byte {
+	tp := NoCompression
+	if conn.compressor != nil {
+		compressed, err := conn.compressor.Compress(data[PacketHeaderSize:])
+		if err == nil && len(compressed) < len(data)-int(PacketHeaderSize) {
+			tp = conn.compressionType
+			copy(data[PacketHeaderSize:], compressed)
+			data = data[:int(PacketHeaderSize)+len(compressed)]
+		}
+	}
+
+	binary.LittleEndian.PutUint16(data[protoOffset:], uint16(protoTypeData)|uint16(tp)<<8)
+	return data
+}
+
+// decompressor is created by type in packet, invoke in read loop
+func (conn *RawConn) decompress(plaintextData PlaintextData) ([]byte, error) {
+	tp := plaintextData.Compression()
+	if tp == NoCompression {
+		return plaintextData.Data(), nil
+	}
+
+	decompressor, ok := conn.decompressors[tp]
+	if !ok {
+		var err error
+		decompressor, err = newCompressor(tp, conn.compressionDict)
+		if err != nil {
+			return nil, err
+		}
+
+		if conn.decompressors == nil {
+			conn.decompressors = make(map[CompressionType]Compressor)
+		}
+
+		conn.decompressors[tp] = decompressor
+	}
+
+	return decompressor.Decompress(plaintextData.Data(), conn.bufferLen)
+}
@@ -0,0 +1,120 @@
+package gouxp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"id":1001,"name":"gouxp","tags":["kcp","udp"]}`), 20)
+	for _, tp := range []CompressionType{UseSnappy, UseZstd} {
+		sender, receiver := &RawConn{bufferLen: 4096}, &RawConn{bufferLen: 4096}
+		if err := sender.SetCompression(tp); err != nil {
+			t.Fatalf("set compression err: %v", err)
+		}
+
+		packet := make([]byte, int(PacketHeaderSize)+len(data))
+		copy(packet[PacketHeaderSize:], data)
+		packet = sender.compress(packet)
+		plaintextData := PlaintextData(packet[protoOffset:])
+		if plaintextData.Type() != protoTypeData || plaintextData.Compression() != tp {
+			t.Fatalf("compression %v invalid PROTO: %v", tp, packet[protoOffset:PacketHeaderSize])
+		}
+
+		if len(packet) >= int(PacketHeaderSize)+len(data) {
+			t.Fatalf("compression %v data isn't smaller", tp)
+		}
+
+		decompressed, err := receiver.decompress(plaintextData)
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Fatalf("compression %v decompress err: %v", tp, err)
+		}
+
+		// incompressible data is sent as it is
+		random := make([]byte, 512)
+		rand.Read(random)
+		packet = make([]byte, int(PacketHeaderSize)+len(random))
+		copy(packet[PacketHeaderSize:], random)
+		packet = sender.compress(packet)
+		plaintextData = PlaintextData(packet[protoOffset:])
+		if plaintextData.Compression() != NoCompression || !bytes.Equal(plaintextData.Data(), random) {
+			t.Fatalf("compression %v incompressible data is changed", tp)
+		}
+
+		// larger than receive buffer
+		receiver.bufferLen = len(data) - 1
+		packet = make([]byte, int(PacketHeaderSize)+len(data))
+		copy(packet[PacketHeaderSize:], data)
+		packet = sender.compress(packet)
+		if _, err := receiver.decompress(PlaintextData(packet[protoOffset:])); err != ErrDecompressedTooLong {
+			t.Fatalf("compression %v too long err: %v", tp, err)
+		}
+	}
+
+	if err := (&RawConn{}).SetCompression(CompressionType(0x80)); err != ErrInvalidCompression {
+		t.Fatalf("unknown compression err: %v", err)
+	}
+}
+
+func TestCompressionDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"player%d","level":%d,"guild":"gouxp","online":true}`, i, i*7, i%60)))
+	}
+
+	dict, err := TrainCompressionDict(7, samples, 4096)
+	if err != nil {
+		t.Fatalf("train dictionary err: %v", err)
+	}
+
+	if id, err := compressionDictID(dict); err != nil || id != 7 {
+		t.Fatalf("dictionary ID: %v, err: %v", id, err)
+	}
+
+	var server, client compressionDicts
+	if server.add(dict) != nil || client.add(dict) != nil || server.add([]byte("not a dictionary")) != ErrInvalidCompressionDict {
+		t.Fatalf("add dictionary failed")
+	}
+
+	if server.choose([]uint32{3, 7}) != 7 || server.choose([]uint32{3}) != 0 {
+		t.Fatalf("choose dictionary failed")
+	}
+
+	if err := (&RawConn{}).SetCompression(UseZstdDict); err != ErrNoCompressionDict {
+		t.Fatalf("no dictionary err: %v", err)
+	}
+
+	if err := RegisterCompressor(UseZstdDict, func() (Compressor, error) { return nil, nil }); err != ErrCompressionRegistered {
+		t.Fatalf("register dictionary type err: %v", err)
+	}
+
+	data := []byte(`{"id":1234,"name":"player8638","level":34,"guild":"gouxp","online":true}`)
+	sender := &RawConn{bufferLen: 4096, compressionDict: client.get(7)}
+	receiver := &RawConn{bufferLen: 4096, compressionDict: server.get(7)}
+	if err := sender.SetCompression(UseZstdDict); err != nil {
+		t.Fatalf("set compression err: %v", err)
+	}
+
+	packet := make([]byte, int(PacketHeaderSize)+len(data))
+	copy(packet[PacketHeaderSize:], data)
+	packet = sender.compress(packet)
+	plaintextData := PlaintextData(packet[protoOffset:])
+	if plaintextData.Compression() != UseZstdDict {
+		t.Fatalf("small payload isn't compressed with dictionary")
+	}
+
+	decompressed, err := receiver.decompress(plaintextData)
+	if err != nil || !bytes.Equal(decompressed, data) {
+		t.Fatalf("decompress err: %v", err)
+	}
+
+	// dictionary IDs in client hello
+	hello := &clientHello{convID: 1, publicKey: make([]byte, keyExchangePublicKeySize), cryptoTypes: []CryptoType{UseChacha20}, dictIDs: []uint32{7, 9},
+		bufferLen: 4096, mtu: 1400}
+	parsed, helloData, err := parseClientHello(hello.encode())
+	if err != nil || len(parsed.dictIDs) != 2 || parsed.dictIDs[1] != 9 || len(helloData) != len(hello.encode()) {
+		t.Fatalf("parse client hello err: %v", err)
+	}
+}
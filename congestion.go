@@ -0,0 +1,343 @@
+package gouxp
+
+import (
+	"encoding/binary"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// CongestionController decides how fast a conn can send.
+// Samples come from KCP segments: PUSH segments sent by conn and ACK segments
+// received from remote.
+type CongestionController interface {
+	// use KCP built-in congestion window or not
+	UseKCPWindow() bool
+	// a PUSH segment has been sent, retransmit means the segment was lost before
+	OnSent(size int, retransmit bool, now uint32)
+	// a PUSH segment has been acknowledged
+	OnACK(rtt uint32, size int, now uint32)
+	// bytes per second, 0 is unlimited
+	PacingRate(now uint32) int
+	// max segments in flight, 0 is unlimited
+	Window(mss int) int
+}
+
+// KCPCongestion use KCP built-in congestion window
+type KCPCongestion struct{}
+
+func NewKCPCongestion() *KCPCongestion {
+	return &KCPCongestion{}
+}
+
+func (cc *KCPCongestion) UseKCPWindow() bool                           { return true }
+func (cc *KCPCongestion) OnSent(size int, retransmit bool, now uint32) {}
+func (cc *KCPCongestion) OnACK(rtt uint32, size int, now uint32)       {}
+func (cc *KCPCongestion) PacingRate(now uint32) int                    { return 0 }
+func (cc *KCPCongestion) Window(mss int) int                           { return 0 }
+
+// NoCongestion send as fast as window allowed, it's gouxp default
+type NoCongestion struct{}
+
+func NewNoCongestion() *NoCongestion {
+	return &NoCongestion{}
+}
+
+func (cc *NoCongestion) UseKCPWindow() bool                           { return false }
+func (cc *NoCongestion) OnSent(size int, retransmit bool, now uint32) {}
+func (cc *NoCongestion) OnACK(rtt uint32, size int, now uint32)       {}
+func (cc *NoCongestion) PacingRate(now uint32) int                    { return 0 }
+func (cc *NoCongestion) Window(mss int) int                           { return 0 }
+
+const (
+	delayMinRTTWindow     = 10000 // min RTT expired after 10s
+	delayMinAdjustTime    = 50
+	delayMinWindow        = 16
+	delayMinLossSamples   = 3
+	delayDefaultStartRate = 128 * 1024
+	// tolerate RTT jitter from delayed ACK of remote KCP
+	delayRTTTolerance = 20
+)
+
+// DelayCongestion is a delay-based controller like BBR:
+// it estimates delivery rate and min RTT from ACKs, probes up while RTT is close to
+// min RTT, backs off when queue is building(RTT growing) or loss rate is high.
+type DelayCongestion struct {
+	minRate    int
+	maxRate    int
+	rate       int
+	srtt       uint32
+	minRTT     uint32
+	minRTTTime uint32
+	roundRTT   uint32
+	sent       int
+	sentBytes  int
+	lost       int
+	acked      int
+	lastAdjust uint32
+}
+
+// minRate and maxRate is bytes per second, maxRate 0 is unlimited
+func NewDelayCongestion(minRate, maxRate int) *DelayCongestion {
+	cc := &DelayCongestion{}
+	cc.minRate = minRate
+	cc.maxRate = maxRate
+	cc.rate = delayDefaultStartRate
+	if cc.rate < minRate {
+		cc.rate = minRate
+	}
+
+	if maxRate > 0 && cc.rate > maxRate {
+		cc.rate = maxRate
+	}
+
+	return cc
+}
+
+func (cc *DelayCongestion) UseKCPWindow() bool {
+	return false
+}
+
+func (cc *DelayCongestion) OnSent(size int, retransmit bool, now uint32) {
+	cc.sent++
+	cc.sentBytes += size
+	if retransmit {
+		cc.lost++
+	}
+}
+
+func (cc *DelayCongestion) OnACK(rtt uint32, size int, now uint32) {
+	if cc.srtt == 0 {
+		cc.srtt = rtt
+	} else {
+		cc.srtt = (7*cc.srtt + rtt) / 8
+	}
+
+	if cc.minRTT == 0 || rtt <= cc.minRTT || now-cc.minRTTTime > delayMinRTTWindow {
+		cc.minRTT = rtt
+		cc.minRTTTime = now
+	}
+
+	if cc.roundRTT == 0 || rtt < cc.roundRTT {
+		cc.roundRTT = rtt
+	}
+
+	cc.acked += size
+}
+
+func (cc *DelayCongestion) PacingRate(now uint32) int {
+	interval := cc.srtt
+	if interval < delayMinAdjustTime {
+		interval = delayMinAdjustTime
+	}
+
+	if cc.lastAdjust == 0 {
+		cc.lastAdjust = now
+	}
+
+	elapsed := now - cc.lastAdjust
+	if elapsed >= interval {
+		cc.adjust(elapsed)
+		cc.lastAdjust = now
+	}
+
+	return cc.rate
+}
+
+func (cc *DelayCongestion) adjust(elapsed uint32) {
+	delivery := int(uint64(cc.acked) * 1000 / uint64(elapsed))
+	switch {
+	case cc.lost >= delayMinLossSamples && cc.lost*10 > cc.sent:
+		// loss rate > 10%
+		cc.rate = cc.rate * 3 / 4
+	case cc.roundRTT > cc.minRTT+cc.minRTT/4+delayRTTTolerance:
+		// even the fastest segment in this round is delayed, queue is building,
+		// back off gently but not lower than delivery rate
+		if delivery < cc.rate {
+			cc.rate = cc.rate * 7 / 8
+			if cc.rate < delivery {
+				cc.rate = delivery
+			}
+		}
+	default:
+		// only probe up when sender is limited by pacing rate, not by application
+		sending := int(uint64(cc.sentBytes) * 1000 / uint64(elapsed))
+		if sending*4 >= cc.rate*3 {
+			cc.rate = cc.rate * 5 / 4
+		}
+	}
+
+	if cc.rate < cc.minRate {
+		cc.rate = cc.minRate
+	}
+
+	if cc.maxRate > 0 && cc.rate > cc.maxRate {
+		cc.rate = cc.maxRate
+	}
+
+	cc.sent = 0
+	cc.sentBytes = 0
+	cc.lost = 0
+	cc.acked = 0
+	cc.roundRTT = 0
+}
+
+// window is twice of BDP
+func (cc *DelayCongestion) Window(mss int) int {
+	if cc.srtt == 0 || mss <= 0 {
+		return 0
+	}
+
+	rtt := cc.srtt + delayRTTTolerance
+	window := int(uint64(cc.rate)*uint64(rtt)/1000) * 2 / mss
+	if window < delayMinWindow {
+		window = delayMinWindow
+	}
+
+	return window
+}
+
+// segments in flight more than this are not sampled
+const congestionSamplerMaxSegments = 65536
+
+type sentSegment struct {
+	size int
+	ts   uint32
+	xmit int
+	sent bool
+}
+
+// congestionSampler parses KCP segments to feed CongestionController and counts
+// how many times a segment is sent for dead link.
+// RTT is measured from the time segment really sent, so waiting in pacing queue is excluded.
+// sent segments are ordered by sn, sent[i] is segment baseSN+i
+type congestionSampler struct {
+	sent     []sentSegment
+	baseSN   uint32
+	nextSN   uint32
+	deadLink int
+	dead     bool
+}
+
+// dead link state is kept
+func (s *congestionSampler) reset() {
+	s.sent = nil
+	s.baseSN = 0
+	s.nextSN = 0
+}
+
+func (s *congestionSampler) add(sn uint32, size int, now uint32) {
+	if len(s.sent) == 0 {
+		s.baseSN = sn
+	}
+
+	index := int32(sn - s.baseSN)
+	if index < 0 {
+		return
+	}
+
+	if int(index) >= congestionSamplerMaxSegments {
+		s.sent = nil
+		s.baseSN = sn
+		index = 0
+	}
+
+	for int(index) >= len(s.sent) {
+		s.sent = append(s.sent, sentSegment{})
+	}
+
+	xmit := s.sent[index].xmit + 1
+	s.sent[index] = sentSegment{size: size, ts: now, xmit: xmit, sent: true}
+	if s.deadLink > 0 && xmit >= s.deadLink {
+		s.dead = true
+	}
+}
+
+func (s *congestionSampler) take(sn uint32) (sentSegment, bool) {
+	index := int32(sn - s.baseSN)
+	if index < 0 || int(index) >= len(s.sent) || !s.sent[index].sent {
+		return sentSegment{}, false
+	}
+
+	seg := s.sent[index]
+	s.sent[index] = sentSegment{}
+	return seg, true
+}
+
+// drop segments before una and acknowledged segments at front
+func (s *congestionSampler) shrink(una uint32) {
+	n := 0
+	for n < len(s.sent) && (int32(s.baseSN-una) < 0 || !s.sent[n].sent) {
+		n++
+		s.baseSN++
+	}
+
+	// append reallocates when reaching capacity, so dropped segments are released
+	s.sent = s.sent[n:]
+}
+
+type kcpSegmentHeader struct {
+	cmd uint32
+	sn  uint32
+	una uint32
+	len uint32
+}
+
+// walk all segments in data, stop when data is invalid
+func eachKCPSegment(data []byte, fn func(h kcpSegmentHeader)) {
+	for len(data) >= int(gokcp.KCP_OVERHEAD) {
+		h := kcpSegmentHeader{}
+		h.cmd = uint32(data[4])
+		h.sn = binary.LittleEndian.Uint32(data[12:])
+		h.una = binary.LittleEndian.Uint32(data[16:])
+		h.len = binary.LittleEndian.Uint32(data[20:])
+		if int(h.len) > len(data)-int(gokcp.KCP_OVERHEAD) {
+			return
+		}
+
+		fn(h)
+		data = data[int(gokcp.KCP_OVERHEAD)+int(h.len):]
+	}
+}
+
+func hasKCPPushSegment(data []byte) bool {
+	found := false
+	eachKCPSegment(data, func(h kcpSegmentHeader) {
+		if h.cmd == gokcp.KCP_CMD_PUSH {
+			found = true
+		}
+	})
+
+	return found
+}
+
+func (s *congestionSampler) onOutput(cc CongestionController, data []byte, now uint32) {
+	eachKCPSegment(data, func(h kcpSegmentHeader) {
+		if h.cmd != gokcp.KCP_CMD_PUSH {
+			return
+		}
+
+		size := int(h.len + gokcp.KCP_OVERHEAD)
+		retransmit := int32(h.sn-s.nextSN) < 0
+		if !retransmit {
+			s.nextSN = h.sn + 1
+		}
+
+		s.add(h.sn, size, now)
+		cc.OnSent(size, retransmit, now)
+	})
+}
+
+func (s *congestionSampler) onInput(cc CongestionController, data []byte, now uint32) {
+	eachKCPSegment(data, func(h kcpSegmentHeader) {
+		if h.cmd != gokcp.KCP_CMD_ACK {
+			return
+		}
+
+		if seg, ok := s.take(h.sn); ok && int32(now-seg.ts) >= 0 {
+			cc.OnACK(now-seg.ts, seg.size, now)
+		}
+
+		// segments before una are acknowledged by remote
+		s.shrink(h.una)
+	})
+}
@@ -0,0 +1,215 @@
+package gouxp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+func appendKCPSegment(data []byte, cmd, sn, una uint32, payload int) []byte {
+	seg := make([]byte, int(gokcp.KCP_OVERHEAD)+payload)
+	seg[4] = byte(cmd)
+	binary.LittleEndian.PutUint32(seg[12:], sn)
+	binary.LittleEndian.PutUint32(seg[16:], una)
+	binary.LittleEndian.PutUint32(seg[20:], uint32(payload))
+	return append(data, seg...)
+}
+
+type recordCongestion struct {
+	NoCongestion
+	sent       int
+	retransmit int
+	acks       []uint32
+}
+
+func (cc *recordCongestion) OnSent(size int, retransmit bool, now uint32) {
+	cc.sent++
+	if retransmit {
+		cc.retransmit++
+	}
+}
+
+func (cc *recordCongestion) OnACK(rtt uint32, size int, now uint32) {
+	cc.acks = append(cc.acks, rtt)
+}
+
+func TestCongestionSampler(t *testing.T) {
+	cc := &recordCongestion{}
+	s := &congestionSampler{}
+	s.reset()
+
+	// sn 100~109 sent at 1000, ACK and window probe segments are ignored
+	var data []byte
+	for sn := uint32(100); sn < 110; sn++ {
+		data = appendKCPSegment(data, gokcp.KCP_CMD_PUSH, sn, 100, 100)
+	}
+
+	data = appendKCPSegment(data, gokcp.KCP_CMD_WASK, 0, 100, 0)
+	s.onOutput(cc, data, 1000)
+	if cc.sent != 10 || cc.retransmit != 0 || len(s.sent) != 10 || s.baseSN != 100 {
+		t.Fatalf("sent: %v, retransmit: %v, in flight: %v", cc.sent, cc.retransmit, len(s.sent))
+	}
+
+	// sn 103 is retransmitted at 1100, RTT is measured from last sent
+	s.onOutput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_PUSH, 103, 100, 100), 1100)
+	if cc.sent != 11 || cc.retransmit != 1 {
+		t.Fatalf("retransmit isn't detected")
+	}
+
+	// out of order ACK doesn't shrink before una
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 105, 100, 0), 1050)
+	if len(cc.acks) != 1 || cc.acks[0] != 50 || len(s.sent) != 10 {
+		t.Fatalf("ack: %v, in flight: %v", cc.acks, len(s.sent))
+	}
+
+	// duplicated ACK is sampled once
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 105, 100, 0), 1060)
+	if len(cc.acks) != 1 {
+		t.Fatalf("duplicated ACK is sampled")
+	}
+
+	// una 103 drops 100~102 without sampling
+	data = appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 103, 103, 0)
+	s.onInput(cc, data, 1130)
+	if len(cc.acks) != 2 || cc.acks[1] != 30 || s.baseSN != 104 || len(s.sent) != 6 {
+		t.Fatalf("ack: %v, base: %v, in flight: %v", cc.acks, s.baseSN, len(s.sent))
+	}
+
+	// 105 is acknowledged already, front shrinks to 106 after 104
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 104, 104, 0), 1200)
+	if len(cc.acks) != 3 || s.baseSN != 106 || len(s.sent) != 4 {
+		t.Fatalf("ack: %v, base: %v, in flight: %v", cc.acks, s.baseSN, len(s.sent))
+	}
+
+	// ACK of segment never sent or before base is ignored
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 200, 106, 0), 1200)
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 100, 106, 0), 1200)
+	if len(cc.acks) != 3 || len(s.sent) != 4 {
+		t.Fatalf("unknown ACK is sampled")
+	}
+
+	// una covers all
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 109, 110, 0), 1300)
+	if len(cc.acks) != 4 || len(s.sent) != 0 {
+		t.Fatalf("ack: %v, in flight: %v", cc.acks, len(s.sent))
+	}
+
+	// sn wraps around
+	s.reset()
+	sn := uint32(0xFFFFFFFE)
+	for i := 0; i < 4; i++ {
+		s.onOutput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_PUSH, sn+uint32(i), sn, 100), 2000)
+	}
+
+	s.onInput(cc, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, sn+2, sn+2, 0), 2010)
+	if len(cc.acks) != 5 || cc.acks[4] != 10 || s.baseSN != 1 || len(s.sent) != 1 {
+		t.Fatalf("wrap around, ack: %v, base: %v, in flight: %v", cc.acks, s.baseSN, len(s.sent))
+	}
+
+	// truncated segment stops parsing
+	data = appendKCPSegment(nil, gokcp.KCP_CMD_PUSH, 1, 0, 100)
+	s.onOutput(cc, data[:len(data)-1], 2000)
+	if cc.sent != 15 {
+		t.Fatalf("truncated segment is sampled")
+	}
+}
+
+func TestDelayCongestion(t *testing.T) {
+	cc := NewDelayCongestion(16*1024, 1024*1024)
+	now := uint32(1000)
+	if cc.UseKCPWindow() || cc.PacingRate(now) != delayDefaultStartRate || cc.Window(1400) != 0 {
+		t.Fatalf("initial state invalid")
+	}
+
+	// sender is limited by pacing rate, RTT is stable: probe up
+	round := func(rtt uint32, lost int) int {
+		rate := cc.rate
+		bytes := rate * 60 / 1000
+		for sent := 0; sent < bytes; sent += 1000 {
+			cc.OnSent(1000, false, now)
+			cc.OnACK(rtt, 1000, now)
+		}
+
+		for i := 0; i < lost; i++ {
+			cc.OnSent(1000, true, now)
+		}
+
+		now += 60
+		return cc.PacingRate(now)
+	}
+
+	if rate := round(50, 0); rate != delayDefaultStartRate*5/4 {
+		t.Fatalf("rate should probe up: %v", rate)
+	}
+
+	// application limited sender doesn't probe up
+	rate := cc.rate
+	cc.OnSent(100, false, now)
+	cc.OnACK(50, 100, now)
+	now += 60
+	if cc.PacingRate(now) != rate {
+		t.Fatalf("application limited sender probes up")
+	}
+
+	// loss rate > 10%
+	if r := round(50, 20); r != rate*3/4 {
+		t.Fatalf("rate should back off by loss: %v, want %v", r, rate*3/4)
+	}
+
+	// queue is building, rate backs off but not lower than delivery rate
+	rate = cc.rate
+	cc.OnSent(1000, false, now)
+	cc.OnACK(200, 1000, now)
+	now += 200
+	if r := cc.PacingRate(now); r != rate*7/8 {
+		t.Fatalf("rate should back off by delay: %v, want %v", r, rate*7/8)
+	}
+
+	rate = cc.rate
+	for i := 0; i < 200; i++ {
+		cc.OnACK(200, 1000, now)
+	}
+
+	cc.OnSent(1000, false, now)
+	now += 200
+	if r := cc.PacingRate(now); r != rate {
+		t.Fatalf("rate backs off lower than delivery rate: %v, want %v", r, rate)
+	}
+
+	// min RTT expires, larger RTT becomes the new base
+	cc.OnACK(200, 1000, now+delayMinRTTWindow+1)
+	if cc.minRTT != 200 {
+		t.Fatalf("min RTT doesn't expire: %v", cc.minRTT)
+	}
+
+	// rate is clamped by minRate and maxRate
+	for i := 0; i < 50; i++ {
+		round(200, 100)
+	}
+
+	if cc.rate != 16*1024 {
+		t.Fatalf("rate is lower than min rate: %v", cc.rate)
+	}
+
+	// rate adjusts once per srtt
+	for i := 0; i < 200; i++ {
+		round(200, 0)
+	}
+
+	if cc.rate != 1024*1024 {
+		t.Fatalf("rate is higher than max rate: %v", cc.rate)
+	}
+
+	// window is twice of BDP, not lower than min window
+	want := int(uint64(cc.rate)*uint64(cc.srtt+delayRTTTolerance)/1000) * 2 / 1400
+	if w := cc.Window(1400); w != want {
+		t.Fatalf("window: %v, want %v", w, want)
+	}
+
+	cc = NewDelayCongestion(0, 0)
+	cc.OnACK(1, 100, now)
+	if w := cc.Window(1400); w != delayMinWindow {
+		t.Fatalf("window: %v, want %v", w, delayMinWindow)
+	}
+}
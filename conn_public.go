@@ -1,40 +1,181 @@
 package gouxp
 
 import (
-	"encoding/binary"
+	"crypto/ed25519"
 	"net"
 	"sync/atomic"
 	"time"
 
-	"github.com/shaoyuan1943/gouxp/dh64"
-
 	"github.com/shaoyuan1943/gokcp"
 )
 
 // ClientConn
-func (conn *ClientConn) UseCryptoCodec(cryptoType CryptoType) {
+func (conn *ClientConn) UseCryptoCodec(cryptoType CryptoType) error {
+	return conn.UseCryptoCodecs(cryptoType)
+}
+
+// crypto types client supports in preference order, server chooses one of them.
+// UseNoCrypto allows server without crypto, default is UseNoCrypto only. MUST invoke before start
+func (conn *ClientConn) UseCryptoCodecs(cryptoTypes ...CryptoType) error {
+	err := checkCryptoTypes(cryptoTypes)
+	if err != nil {
+		return err
+	}
+
 	conn.Lock()
 	defer conn.Unlock()
 
-	conn.cryptoCodec = createCryptoCodec(cryptoType)
+	conn.cryptoTypes = append([]CryptoType(nil), cryptoTypes...)
+	return nil
 }
 
-func (conn *ClientConn) Start() error {
-	var handshakeBuffer [handshakeBufferSize]byte
-	binary.LittleEndian.PutUint16(handshakeBuffer[macSize:], uint16(protoTypeHandshake))
-	binary.LittleEndian.PutUint32(handshakeBuffer[PacketHeaderSize:], conn.convID)
+// PSK protects handshake, server MUST have the same key with keyID, key MUST be 32bytes
+// MUST invoke before start
+func (conn *ClientConn) SetPreSharedKey(keyID uint32, key []byte) error {
+	err := checkPreSharedKey(keyID, key)
+	if err != nil {
+		return err
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.pskID = keyID
+	conn.psk = append([]byte(nil), key...)
+	return nil
+}
+
+// pinned server identity key or a small trust list, handshake fails with ErrServerAuthFailed
+// when server signature doesn't match any of them. MUST invoke before start
+func (conn *ClientConn) TrustServerKeys(keys ...ed25519.PublicKey) error {
+	for _, key := range keys {
+		if len(key) != ed25519.PublicKeySize {
+			return ErrInvalidIdentityKey
+		}
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.trustedKeys = append([]ed25519.PublicKey(nil), keys...)
+	return nil
+}
 
-	if conn.cryptoCodec != nil {
-		conn.cryptoKeys.privateKey, conn.cryptoKeys.publicKey = dh64.KeyPair()
-		binary.LittleEndian.PutUint64(handshakeBuffer[PacketHeaderSize+4:], conn.cryptoKeys.publicKey)
+// Noise NK handshake, server is authenticated by its X25519 static public key
+// MUST invoke before start
+func (conn *ClientConn) UseNoiseNK(serverKey []byte) error {
+	err := checkNoiseKey(serverKey)
+	if err != nil {
+		return err
 	}
 
-	cipherData, err := conn.encrypt(handshakeBuffer[:])
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.noisePattern = noiseNK
+	conn.noiseKey = nil
+	conn.noiseServerKeys = [][]byte{append([]byte(nil), serverKey...)}
+	return nil
+}
+
+// Noise XX handshake, both sides send X25519 static keys encrypted and prove them.
+// server static key MUST be one of serverKeys if any, server gets client static key from
+// ServerConn.RemoteStaticKey. MUST invoke before start
+func (conn *ClientConn) UseNoiseXX(staticKey []byte, serverKeys ...[]byte) error {
+	err := checkNoiseKey(staticKey)
 	if err != nil {
 		return err
 	}
 
-	_, err = conn.rwc.WriteTo(cipherData, conn.addr)
+	for _, key := range serverKeys {
+		err = checkNoiseKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.noisePattern = noiseXX
+	conn.noiseKey = append([]byte(nil), staticKey...)
+	conn.noiseServerKeys = nil
+	for _, key := range serverKeys {
+		conn.noiseServerKeys = append(conn.noiseServerKeys, append([]byte(nil), key...))
+	}
+
+	return nil
+}
+
+// Ed25519 key proves client identity in default handshake, server checks it with keyring.
+// Noise XX handshake uses its static key instead. MUST invoke before start
+func (conn *ClientConn) SetClientKey(key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return ErrInvalidIdentityKey
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.clientKey = key
+	return nil
+}
+
+// zstd dictionary for UseZstdDict, trained by TrainCompressionDict. client offers all of them,
+// server chooses one it also has. MUST invoke before start
+func (conn *ClientConn) AddCompressionDict(dict []byte) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.dicts.add(dict)
+}
+
+func (conn *ClientConn) Start() error {
+	var protoType ProtoType
+	var data []byte
+	if conn.noisePattern != 0 {
+		var serverKey []byte
+		if conn.noisePattern == noiseNK {
+			serverKey = conn.noiseServerKeys[0]
+		}
+
+		hs, err := newNoiseHandshake(conn.noisePattern, true, conn.noiseKey, serverKey)
+		if err != nil {
+			return err
+		}
+
+		message, err := hs.writeMessage(encodeNoiseClientPayload(conn.convID, conn.cryptoTypes, conn.dicts.ids, conn.fecConfig, conn.bufferLen, int(conn.kcp.MTU())))
+		if err != nil {
+			return err
+		}
+
+		conn.noise = hs
+		protoType, data = protoTypeNoiseHandshake, noiseMessage(conn.noisePattern, 0, message)
+	} else {
+		kx, err := newX25519KeyExchange()
+		if err != nil {
+			return err
+		}
+
+		conn.keyExchange = kx
+		hello := &clientHello{convID: conn.convID, publicKey: kx.PublicKey(), cryptoTypes: conn.cryptoTypes, dictIDs: conn.dicts.ids, fec: conn.fecConfig,
+			bufferLen: conn.bufferLen, mtu: int(conn.kcp.MTU())}
+		if conn.clientKey != nil {
+			hello.identity = &ClientIdentity{KeyType: ClientKeyEd25519, PublicKey: conn.clientKey.Public().(ed25519.PublicKey)}
+		}
+
+		// keep plaintext for session key derivation, encrypt is in place
+		conn.handshakeData = hello.encode()
+		if conn.clientKey != nil {
+			signed := conn.handshakeData[:len(conn.handshakeData)-identitySignatureSize]
+			copy(conn.handshakeData[len(signed):], signClientIdentity(conn.clientKey, signed))
+		}
+
+		protoType, data = protoTypeHandshake, conn.handshakeData
+	}
+
+	conn.cryptoEncoder, conn.cryptoDecoder = newHandshakeCodecs(conn.psk)
+	err := conn.writeHandshake(protoType, data)
 	if err != nil {
 		return err
 	}
@@ -50,28 +191,98 @@ func NewClientConn(rwc net.PacketConn, addr net.Addr, handler ConnHandler, buffe
 	conn.addr = addr
 	conn.handler = handler
 	conn.closeC = make(chan struct{})
-	conn.kcp = gokcp.NewKCP(conn.convID, conn.onKCPDataOutput)
-	conn.kcp.SetBufferReserved(int(PacketHeaderSize))
-	conn.kcp.SetNoDelay(true, 10, 2, true)
+	conn.initKCP(conn.convID, defaultKCPProfile)
 	conn.closed.Store(false)
 	conn.connCloser = conn
 	conn.bufferLen = bufferLen
+	conn.pskID = defaultPreSharedKeyID
+	conn.psk = InitCryptoKey
+	conn.cryptoTypes = []CryptoType{UseNoCrypto}
+	conn.keyUpdater.setPolicy(defaultRekeyPackets, defaultRekeyInterval)
+	conn.fecFlushTimeout = defaultFECFlushTimeout
 	return conn
 }
 
 // ClientConn end
 
 // RawConn
-func (conn *RawConn) EnableFEC() {
+// FEC with FECDataShards and FECParityShards
+func (conn *RawConn) EnableFEC() error {
+	return conn.EnableFECWithConfig(FECDataShards, FECParityShards)
+}
+
+// FEC group is dataShards KCP packets and parityShards parity packets. before handshake client asks
+// server for the shards, both sides enable FEC when handshake is done. after handshake remote MUST
+// use the same shards. KCP MTU with FEC header MUST fit read buffer. enabled FEC with other shards
+// is replaced, parity of queued group isn't sent
+func (conn *RawConn) EnableFECWithConfig(dataShards, parityShards int) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	err := checkFECConfig(dataShards, parityShards, int(conn.kcp.MTU()), conn.bufferLen)
+	if err != nil {
+		return err
+	}
+
+	cfg := fecConfig{dataShards: dataShards, parityShards: parityShards}
+	if !conn.reconfigurer.established {
+		conn.fecConfig = cfg
+		return nil
+	}
+
+	conn.enableFEC(cfg)
+	return nil
+}
+
+// data shards are sent at once, parity of group which isn't full is sent after timeout(ms).
+// 0 disables it, partial group waits for more packets. default is 20ms, can invoke at any time
+func (conn *RawConn) SetFECFlushTimeout(timeout int) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.fecFlushTimeout = timeout
+}
+
+// parity shard count follows loss remote reports, between minParity and maxParity.
+// minParity 0 switches parity off on clean links, data shard count isn't changed.
+// FEC MUST be enabled, remote needn't enable it, it reports loss when asked
+func (conn *RawConn) EnableAdaptiveFEC(minParity, maxParity int) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	dataShards := conn.fecConfig.dataShards
+	if dataShards == 0 || minParity < 0 || minParity > maxParity || dataShards+maxParity > maxFECShards {
+		return ErrInvalidFecConfig
+	}
+
+	a := &conn.fecAdapter
+	if !a.enabled {
+		a.configParity = conn.fecConfig.parityShards
+	}
+
+	a.enabled = true
+	a.minParity, a.maxParity = minParity, maxParity
+	a.sent, a.retransmitted = 0, 0
+	if conn.fecEncoder == nil {
+		return nil
+	}
+
+	return conn.fecEncoder.setParityShards(a.clampParity(conn.fecEncoder.nextParity))
+}
+
+// parity shard count goes back to config
+func (conn *RawConn) DisableAdaptiveFEC() {
 	conn.Lock()
 	defer conn.Unlock()
 
-	if conn.fecEncoder != nil && conn.fecDecoder != nil {
+	if !conn.fecAdapter.enabled {
 		return
 	}
 
-	conn.fecEncoder = NewFecEncoder(FECDataShards, FECParityShards, int(conn.kcp.MTU())+fecHeaderSize)
-	conn.fecDecoder = NewFecDecoder(FECDataShards, FECParityShards, int(conn.kcp.MTU())+fecHeaderSize)
+	conn.fecAdapter.enabled = false
+	if conn.fecEncoder != nil {
+		conn.fecEncoder.setParityShards(conn.fecAdapter.configParity)
+	}
 }
 
 // For use KCP status:
@@ -108,6 +319,72 @@ func (conn *RawConn) StopKCPStatus() {
 	}
 }
 
+// ServerConn
+// client static key of Noise XX handshake, nil for other handshakes
+func (conn *ServerConn) RemoteStaticKey() []byte {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.remoteStaticKey
+}
+
+// client key proved in handshake, nil if client has no key
+func (conn *ServerConn) ClientIdentity() *ClientIdentity {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.clientIdentity
+}
+
+// ServerConn end
+
+// compress KCP data before crypto, remote decompresses by type in packet.
+// remote MUST support the type, built-in types are always supported. can invoke at any time,
+// UseZstdDict fails with ErrNoCompressionDict before handshake or if no dictionary is agreed
+func (conn *RawConn) SetCompression(tp CompressionType) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	var compressor Compressor
+	if tp != NoCompression {
+		var err error
+		compressor, err = newCompressor(tp, conn.compressionDict)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.compressor = compressor
+	conn.compressionType = tp
+	return nil
+}
+
+// ID of zstd dictionary agreed in handshake, 0 if none
+func (conn *RawConn) CompressionDictID() uint32 {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.compressionDictID
+}
+
+// crypto type chosen in handshake
+func (conn *RawConn) CryptoType() CryptoType {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.cryptoType
+}
+
+// update send key after packets sent or interval(ms) elapsed, whichever comes first,
+// 0 disables it. update is at most once every 10s. default is 16M packets or 1 hour.
+// can invoke at any time
+func (conn *RawConn) SetRekeyPolicy(packets, interval int) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.keyUpdater.setPolicy(packets, interval)
+}
+
 func (conn *RawConn) ID() uint32 {
 	return conn.kcp.ConvID()
 }
@@ -119,44 +396,181 @@ func (conn *RawConn) SetConnHandler(handler ConnHandler) {
 	conn.handler = handler
 }
 
-// MUST invoke before start
-func (conn *RawConn) SetWindow(sndWnd, rcvWnd int) {
+// can invoke at any time, after handshake remote is asked to grow its receive window
+// to sndWnd at least
+func (conn *RawConn) SetWindow(sndWnd, rcvWnd int) bool {
 	conn.Lock()
 	defer conn.Unlock()
 
+	if sndWnd <= 0 || rcvWnd <= 0 || sndWnd > controlMaxWndSize || rcvWnd > controlMaxWndSize {
+		return false
+	}
+
+	conn.sndWnd = sndWnd
+	conn.rcvWnd = rcvWnd
 	conn.kcp.SetWndSize(sndWnd, rcvWnd)
+	if conn.reconfigurer.established {
+		conn.requestReconfig(0, gokcp.SetupFromNowMS())
+	}
+
+	return true
 }
 
-// MUST invoke before start
+// can invoke at any time, before handshake MTU is changed at once. after handshake it returns
+// true when request is sent, MTU is changed when remote confirms it can receive packets of
+// this size, see MTU. MTU set by user stops MTU discovery
 func (conn *RawConn) SetMTU(mtu int) bool {
 	conn.Lock()
 	defer conn.Unlock()
 
-	if mtu >= conn.bufferLen {
+	if mtu >= conn.bufferLen || mtu < int(gokcp.KCP_OVERHEAD)+int(PacketHeaderSize) {
 		return false
 	}
 
-	result := conn.kcp.SetMTU(mtu)
-	if !result {
-		return false
+	conn.stopMTUDiscovery()
+	if conn.reconfigurer.established {
+		return conn.requestReconfig(mtu, gokcp.SetupFromNowMS()) == nil
+	}
+
+	return conn.resizeMTU(mtu)
+}
+
+// KCP MTU in use
+func (conn *RawConn) MTU() int {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return int(conn.kcp.MTU())
+}
+
+// probe path MTU between minMTU and maxMTU after handshake and every 10min,
+// KCP MTU and FEC buffer are adjusted to the largest working size, MTU requested by
+// SetMTU and not confirmed yet is dropped.
+// maxMTU MUST be less than bufferLen, minMTU less than 576 is adjusted to 576
+func (conn *RawConn) EnableMTUDiscovery(minMTU, maxMTU int) bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if minMTU < mtuProbeMinMTU {
+		minMTU = mtuProbeMinMTU
 	}
 
-	result = conn.kcp.SetBufferReserved(int(PacketHeaderSize))
-	if !result {
+	if maxMTU >= conn.bufferLen || maxMTU < minMTU {
 		return false
 	}
 
+	if conn.reconfigurer.pending != nil {
+		conn.reconfigurer.pending.mtu = 0
+	}
+
+	conn.mtuProber.enabled = true
+	conn.mtuProber.minMTU = minMTU
+	conn.mtuProber.maxMTU = maxMTU
+	conn.mtuProber.restart(gokcp.SetupFromNowMS())
 	return true
 }
 
-// MUST invoke before start
+func (conn *RawConn) DisableMTUDiscovery() {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.stopMTUDiscovery()
+}
+
+// can invoke at any time
 func (conn *RawConn) SetUpdateInterval(interval int) {
 	conn.Lock()
 	defer conn.Unlock()
 
+	conn.profile.Interval = interval
 	conn.kcp.SetInterval(interval)
 }
 
+// apply KCP parameters set, congestion controller is reset to NoCongestion or KCPCongestion
+// by profile.NoCongestion unless it's set by SetCongestionControl.
+// can invoke at any time
+func (conn *RawConn) ApplyKCPProfile(profile KCPProfile) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.setProfile(profile)
+}
+
+func (conn *RawConn) KCPProfile() KCPProfile {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.profile
+}
+
+// same as KCP nodelay, nc is disable KCP congestion window
+func (conn *RawConn) SetNoDelay(noDelay bool, interval, resend int, nc bool) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	profile := conn.profile
+	profile.NoDelay = noDelay
+	profile.Interval = interval
+	profile.Resend = resend
+	profile.NoCongestion = nc
+	conn.setProfile(profile)
+}
+
+// conn is closed with ErrDeadLink when a segment is sent deadLink times, 0 is disable it
+func (conn *RawConn) SetDeadLink(deadLink int) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.profile.DeadLink = deadLink
+	conn.applyProfile()
+}
+
+// default is NoCongestion, it's kept when KCP profile changes. nil gives control back to
+// profile.NoCongestion. can invoke at any time
+func (conn *RawConn) SetCongestionControl(cc CongestionController) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.customCongestion = cc != nil
+	if cc == nil {
+		conn.setProfile(conn.profile)
+		return
+	}
+
+	conn.congestion = cc
+	conn.sampler.reset()
+	conn.bandwidth.pacing = nil
+	conn.kcp.SetWndSize(conn.sndWnd, conn.rcvWnd)
+	conn.applyProfile()
+}
+
+// upload and download limit, bytes per second, 0 is unlimited
+// can invoke at any time
+func (conn *RawConn) SetBandwidth(upload, download int) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	now := gokcp.SetupFromNowMS()
+	resetBandwidthBucket(&conn.bandwidth.upload, upload, now)
+	resetBandwidthBucket(&conn.bandwidth.download, download, now)
+}
+
+func (conn *RawConn) setBandwidthShare(upload, download int) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	now := gokcp.SetupFromNowMS()
+	resetBandwidthBucket(&conn.bandwidth.uploadShare, upload, now)
+	resetBandwidthBucket(&conn.bandwidth.downloadShare, download, now)
+}
+
+func (conn *RawConn) isActive(now uint32) bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return len(conn.bandwidth.pending) > 0 || now-conn.bandwidth.lastActive < bandwidthActiveTimeout
+}
+
 func (conn *RawConn) IsClosed() bool {
 	return conn.closed.Load().(bool) == true
 }
@@ -178,6 +592,15 @@ func (conn *RawConn) Write(data []byte) (int, error) {
 	conn.Lock()
 	defer conn.Unlock()
 
+	// MTU is shrinking, data is sent to KCP after it
+	if conn.holding() {
+		if !conn.holdWrite(data) {
+			return 0, ErrTryAgain
+		}
+
+		return n, nil
+	}
+
 	waitSend := conn.kcp.WaitSend()
 	if waitSend < int(conn.kcp.SendWnd()) && waitSend < int(conn.kcp.RemoteWnd()) {
 		err := conn.kcp.Send(data)
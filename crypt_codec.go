@@ -1,8 +1,12 @@
 package gouxp
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"sync"
 	"sync/atomic"
 
 	"golang.org/x/crypto/poly1305"
@@ -24,30 +28,73 @@ var (
 	InitCryptoNonce = []byte("0D74DB42A91077DEB3E91E43")
 )
 
+// nonce buffer on stack, large enough for all codecs
+const maxNonceSize = 24
+
 type CryptoNonce struct {
 	data []byte
 }
 
-func (nonce *CryptoNonce) incr() {
-	l := len(nonce.data)
-	if l > 8 {
-		l = 8
+// nonce of packet by its packet number
+type packetNoncer interface {
+	packetNonce(pn uint64, dst []byte) []byte
+}
+
+// nonce of packet is base nonce XOR packet number
+func (nonce *CryptoNonce) packetNonce(pn uint64, dst []byte) []byte {
+	dst = dst[:len(nonce.data)]
+	copy(dst, nonce.data)
+	binary.LittleEndian.PutUint64(dst, binary.LittleEndian.Uint64(dst)^pn)
+	return dst
+}
+
+// packet number is written in plaintext at packet head and authenticated with data,
+// it increases for every packet so nonce is never reused under same key
+type packetNumbers struct {
+	writePN uint64
+	replay  replayWindow
+}
+
+// new key restarts packet number from random value
+func (p *packetNumbers) reset(initial uint64) {
+	atomic.StoreUint64(&p.writePN, initial)
+	p.replay.reset()
+}
+
+func (p *packetNumbers) next() uint64 {
+	return atomic.AddUint64(&p.writePN, 1) - 1
+}
+
+// handshake key is shared by connections, random start avoids nonce reuse between connections.
+// 62 bits are random, nonces of two handshakes collide after about 2^31 handshakes. highest bit
+// is key phase, next one keeps it clear while PN increases
+func randomPacketNumber() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
 	}
 
-	n := binary.LittleEndian.Uint64(nonce.data[:l])
-	n++
-	binary.LittleEndian.PutUint64(nonce.data[:l], n)
+	return binary.LittleEndian.Uint64(b[:]) >> 2
 }
 
 type Chacha20poly1305Crypto struct {
+	packetNumbers
 	aead       cipher.AEAD
 	key        [32]byte
 	readNonce  atomic.Value
 	writeNonce atomic.Value
 }
 
+// AEAD is rebuilt with new key
 func (codec *Chacha20poly1305Crypto) SetKey(key []byte) {
 	copy(codec.key[:], key)
+	aead, err := chacha20poly1305.New(codec.key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	codec.aead = aead
+	codec.reset(randomPacketNumber())
 }
 
 func (codec *Chacha20poly1305Crypto) setNonce(nonce []byte, nonceValue *atomic.Value) {
@@ -68,24 +115,58 @@ func (codec *Chacha20poly1305Crypto) SetWriteNonce(nonce []byte) {
 	codec.setNonce(nonce, &codec.writeNonce)
 }
 
-// change data format |---MAC---|---DATA---| to |---DATA---|---MAC---|
+// change data format |---PN---|---MAC---|---DATA---| to |---PN---|---DATA---|---MAC---|
+// PN is additional data of AEAD
+func aeadSeal(aead cipher.AEAD, p *packetNumbers, writeNonce packetNoncer, src []byte) (dst []byte, err error) {
+	if len(src) < int(protoOffset) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	pn := p.next()
+	binary.LittleEndian.PutUint64(src, pn)
+	copy(src[packetNumberSize:], src[protoOffset:])
+
+	var nonceBuffer [maxNonceSize]byte
+	nonce := writeNonce.packetNonce(pn, nonceBuffer[:])
+	plaintext := src[packetNumberSize : len(src)-aead.Overhead()]
+	aead.Seal(plaintext[:0], nonce, plaintext, src[:packetNumberSize])
+	return src, nil
+}
+
+func aeadOpen(aead cipher.AEAD, p *packetNumbers, readNonce packetNoncer, src []byte) (dst []byte, err error) {
+	if len(src) < int(protoOffset) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	pn := binary.LittleEndian.Uint64(src)
+	if !p.replay.check(pn) {
+		return nil, ErrReplayedPacket
+	}
+
+	var nonceBuffer [maxNonceSize]byte
+	nonce := readNonce.packetNonce(pn, nonceBuffer[:])
+	dst, err = aead.Open(src[packetNumberSize:packetNumberSize], nonce, src[packetNumberSize:], src[:packetNumberSize])
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.replay.update(pn) {
+		return nil, ErrReplayedPacket
+	}
+
+	return dst, nil
+}
+
 func (codec *Chacha20poly1305Crypto) Encrypt(src []byte) (dst []byte, err error) {
-	copy(src, src[codec.aead.Overhead():len(src)])
-	nonce := codec.writeNonce.Load().(*CryptoNonce)
-	dst = codec.aead.Seal(src[:0], nonce.data, src[:len(src)-codec.aead.Overhead()], nil)
-	//nonce.incr()
-	return
+	return aeadSeal(codec.aead, &codec.packetNumbers, codec.writeNonce.Load().(*CryptoNonce), src)
 }
 
 func (codec *Chacha20poly1305Crypto) Decrypt(src []byte) (dst []byte, err error) {
-	nonce := codec.readNonce.Load().(*CryptoNonce)
-	dst, err = codec.aead.Open(src[:0], nonce.data, src, nil)
-	//nonce.incr()
-	return
+	return aeadOpen(codec.aead, &codec.packetNumbers, codec.readNonce.Load().(*CryptoNonce), src)
 }
 
 // In chacha20poly1305, data format is |---DATA---|---MAC---|
-// In gouxp, data format is |---MAC---|---DATA---|
+// In gouxp, data format is |---PN---|---MAC---|---DATA---|
 // When use chacha20poly1305, must modify data format to adapt chacha20poly1305.
 
 // Chacha20poly1305 use 12bytes nonce
@@ -98,36 +179,169 @@ func NewChacha20poly1305CryptoCodec() *Chacha20poly1305Crypto {
 	codec.SetReadNonce(InitCryptoNonce)
 	codec.SetWriteNonce(InitCryptoNonce)
 
-	aead, err := chacha20poly1305.New(codec.key[:])
+	// IMPORTANT!
+	// In gouxp, reserved MAC size is 16bytes in data head, so your encoder MUST use 16bytes MAC
+	if codec.aead.Overhead() != int(macSize) {
+		panic("reserved mac size invalid")
+	}
+
+	return codec
+}
+
+type XChacha20poly1305Crypto struct {
+	packetNumbers
+	aead  cipher.AEAD
+	key   [32]byte
+	nonce xchachaNonce
+}
+
+var xchachaNonceLabel = []byte("gouxp xchacha nonce")
+
+// nonce of packet is keyed hash of its packet number, it looks random and is new for every packet
+type xchachaNonce struct {
+	key [sha256.Size]byte
+}
+
+func (nonce *xchachaNonce) packetNonce(pn uint64, dst []byte) []byte {
+	var buffer [sha256.Size + packetNumberSize]byte
+	copy(buffer[:], nonce.key[:])
+	binary.LittleEndian.PutUint64(buffer[sha256.Size:], pn)
+	sum := sha256.Sum256(buffer[:])
+	dst = dst[:chacha20poly1305.NonceSizeX]
+	copy(dst, sum[:])
+	return dst
+}
+
+func (codec *XChacha20poly1305Crypto) SetKey(key []byte) {
+	copy(codec.key[:], key)
+	aead, err := chacha20poly1305.NewX(codec.key[:])
 	if err != nil {
 		panic(err)
 	}
 
-	// IMPORTANT!
-	// In gouxp, reserved MAC size is 16bytes in data head, so your encoder MUST use 16bytes MAC
-	if aead.Overhead() < int(macSize) {
-		panic("reserved mac size invalid")
+	codec.aead = aead
+	codec.nonce.key = sha256.Sum256(append(append([]byte(nil), xchachaNonceLabel...), codec.key[:]...))
+	codec.reset(randomPacketNumber())
+}
+
+// nonce comes from key and packet number, session nonce isn't used
+func (codec *XChacha20poly1305Crypto) SetReadNonce(nonce []byte) {}
+
+func (codec *XChacha20poly1305Crypto) SetWriteNonce(nonce []byte) {}
+
+func (codec *XChacha20poly1305Crypto) Encrypt(src []byte) (dst []byte, err error) {
+	return aeadSeal(codec.aead, &codec.packetNumbers, &codec.nonce, src)
+}
+
+func (codec *XChacha20poly1305Crypto) Decrypt(src []byte) (dst []byte, err error) {
+	return aeadOpen(codec.aead, &codec.packetNumbers, &codec.nonce, src)
+}
+
+// XChacha20poly1305 use 24bytes nonce, it is hash of packet number keyed by session key, so it
+// is random for every packet and doesn't depend on counters kept in step by both peers.
+// packet format is the same as Chacha20poly1305, MAC is moved to the end:
+// |---PN---|---DATA---|---MAC---|
+func NewXChacha20poly1305CryptoCodec() *XChacha20poly1305Crypto {
+	codec := &XChacha20poly1305Crypto{}
+	codec.SetKey(InitCryptoKey)
+	return codec
+}
+
+type AESGCMCrypto struct {
+	packetNumbers
+	aead       cipher.AEAD
+	key        [32]byte
+	keySize    int
+	readNonce  atomic.Value
+	writeNonce atomic.Value
+}
+
+// AES-128 uses the first 16bytes of key
+func (codec *AESGCMCrypto) SetKey(key []byte) {
+	copy(codec.key[:], key)
+	block, err := aes.NewCipher(codec.key[:codec.keySize])
+	if err != nil {
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
 	}
 
 	codec.aead = aead
+	codec.reset(randomPacketNumber())
+}
+
+func (codec *AESGCMCrypto) setNonce(nonce []byte, nonceValue *atomic.Value) {
+	if len(nonce) < aesGCMNonceSize {
+		panic(ErrInvalidNonceSize)
+	}
+
+	cryptoNonce := nonceValue.Load().(*CryptoNonce)
+	copy(cryptoNonce.data[:], nonce)
+	nonceValue.Store(cryptoNonce)
+}
+
+func (codec *AESGCMCrypto) SetReadNonce(nonce []byte) {
+	codec.setNonce(nonce, &codec.readNonce)
+}
+
+func (codec *AESGCMCrypto) SetWriteNonce(nonce []byte) {
+	codec.setNonce(nonce, &codec.writeNonce)
+}
+
+// MAC is moved to the end like Chacha20poly1305Crypto
+func (codec *AESGCMCrypto) Encrypt(src []byte) (dst []byte, err error) {
+	return aeadSeal(codec.aead, &codec.packetNumbers, codec.writeNonce.Load().(*CryptoNonce), src)
+}
+
+func (codec *AESGCMCrypto) Decrypt(src []byte) (dst []byte, err error) {
+	return aeadOpen(codec.aead, &codec.packetNumbers, codec.readNonce.Load().(*CryptoNonce), src)
+}
+
+// AES-GCM use 12bytes nonce and 16bytes MAC, fast on CPU with AES-NI
+func newAESGCMCryptoCodec(keySize int) *AESGCMCrypto {
+	codec := &AESGCMCrypto{keySize: keySize}
+	codec.readNonce.Store(&CryptoNonce{data: make([]byte, aesGCMNonceSize)})
+	codec.writeNonce.Store(&CryptoNonce{data: make([]byte, aesGCMNonceSize)})
+	codec.SetKey(InitCryptoKey)
+	codec.SetReadNonce(InitCryptoNonce)
+	codec.SetWriteNonce(InitCryptoNonce)
+
+	if codec.aead.Overhead() != int(macSize) {
+		panic("reserved mac size invalid")
+	}
+
 	return codec
 }
 
+func NewAES128GCMCryptoCodec() *AESGCMCrypto {
+	return newAESGCMCryptoCodec(16)
+}
+
+func NewAES256GCMCryptoCodec() *AESGCMCrypto {
+	return newAESGCMCryptoCodec(32)
+}
+
 var zeroValue atomic.Value
 
 type Salsa20Crypto struct {
-	enMacBuf      [macSize]byte // avoid make array every times
-	deMacBuf      [macSize]byte
+	packetNumbers
 	key           [32]byte
-	enPoly1305Key [32]byte
+	macKey        [32]byte
+	enPoly1305Key [32]byte // avoid make array every times
 	dePoly1305Key [32]byte
 	readNonce     atomic.Value
 	writeNonce    atomic.Value
 	nonceSize     int
 }
 
+// poly1305 key is generated from another key, keystream of data and poly1305 key never overlap
 func (codec *Salsa20Crypto) SetKey(key []byte) {
 	copy(codec.key[:], key)
+	codec.macKey = sha256.Sum256(append([]byte("gouxp salsa20 poly1305 key"), codec.key[:]...))
+	codec.reset(randomPacketNumber())
 }
 
 func (codec *Salsa20Crypto) setNonce(nonce []byte, nonceValue *atomic.Value) {
@@ -160,52 +374,247 @@ func NewSalsa20CryptoCodec() *Salsa20Crypto {
 	return codec
 }
 
+// MAC is poly1305 of | PN | cipher data |
+func (codec *Salsa20Crypto) sum(src []byte, poly1305Key *[32]byte) *poly1305.MAC {
+	mac := poly1305.New(poly1305Key)
+	mac.Write(src[:packetNumberSize])
+	mac.Write(src[protoOffset:])
+	return mac
+}
+
 func (codec *Salsa20Crypto) Encrypt(src []byte) (dst []byte, err error) {
-	nonce := codec.writeNonce.Load().(*CryptoNonce)
-	salsa20.XORKeyStream(src[macSize:], src[macSize:], nonce.data, &codec.key)
+	if len(src) < int(protoOffset) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	pn := codec.next()
+	binary.LittleEndian.PutUint64(src, pn)
+
+	var nonceBuffer [8]byte
+	nonce := codec.writeNonce.Load().(*CryptoNonce).packetNonce(pn, nonceBuffer[:])
+	salsa20.XORKeyStream(src[protoOffset:], src[protoOffset:], nonce, &codec.key)
 
-	salsa20.XORKeyStream(codec.enPoly1305Key[:], codec.enPoly1305Key[:], nonce.data, &codec.key)
-	poly1305.Sum(&codec.enMacBuf, src[macSize:], &codec.enPoly1305Key)
-	copy(src, codec.enMacBuf[:])
+	salsa20.XORKeyStream(codec.enPoly1305Key[:], codec.enPoly1305Key[:], nonce, &codec.macKey)
+	codec.sum(src, &codec.enPoly1305Key).Sum(src[macOffset:macOffset])
 
 	zero := zeroValue.Load().([]byte)
 	copy(codec.enPoly1305Key[:], zero)
-	// nonce.incr()
 	return src, nil
 }
 
 func (codec *Salsa20Crypto) Decrypt(src []byte) (dst []byte, err error) {
-	nonce := codec.readNonce.Load().(*CryptoNonce)
-	salsa20.XORKeyStream(codec.dePoly1305Key[:], codec.dePoly1305Key[:], nonce.data, &codec.key)
-	copy(codec.deMacBuf[:], src[:macSize])
-
-	if !poly1305.Verify(&codec.deMacBuf, src[macSize:], &codec.dePoly1305Key) {
+	if len(src) < int(protoOffset) {
 		return nil, ErrMessageAuthFailed
 	}
 
-	salsa20.XORKeyStream(src[macSize:], src[macSize:], nonce.data, &codec.key)
+	pn := binary.LittleEndian.Uint64(src)
+	if !codec.replay.check(pn) {
+		return nil, ErrReplayedPacket
+	}
+
+	var nonceBuffer [8]byte
+	nonce := codec.readNonce.Load().(*CryptoNonce).packetNonce(pn, nonceBuffer[:])
+	salsa20.XORKeyStream(codec.dePoly1305Key[:], codec.dePoly1305Key[:], nonce, &codec.macKey)
+	verified := codec.sum(src, &codec.dePoly1305Key).Verify(src[macOffset:protoOffset])
 	zero := zeroValue.Load().([]byte)
 	copy(codec.dePoly1305Key[:], zero)
-	// nonce.incr()
-	return src[macSize:], nil
+	if !verified {
+		return nil, ErrMessageAuthFailed
+	}
+
+	if !codec.replay.update(pn) {
+		return nil, ErrReplayedPacket
+	}
+
+	salsa20.XORKeyStream(src[protoOffset:], src[protoOffset:], nonce, &codec.key)
+	return src[protoOffset:], nil
+}
+
+// integrity only, data is plaintext and MAC is poly1305 of | PN | data |.
+// one-time poly1305 key of every packet is salsa20 keystream of session key and packet nonce
+type Poly1305AuthCrypto struct {
+	packetNumbers
+	macKey     [32]byte
+	readNonce  atomic.Value
+	writeNonce atomic.Value
+}
+
+func (codec *Poly1305AuthCrypto) SetKey(key []byte) {
+	var k [32]byte
+	copy(k[:], key)
+	codec.macKey = sha256.Sum256(append([]byte("gouxp poly1305 auth key"), k[:]...))
+	codec.reset(randomPacketNumber())
+}
+
+func (codec *Poly1305AuthCrypto) setNonce(nonce []byte, nonceValue *atomic.Value) {
+	if len(nonce) < 8 {
+		panic(ErrInvalidNonceSize)
+	}
+
+	cryptoNonce := nonceValue.Load().(*CryptoNonce)
+	copy(cryptoNonce.data[:], nonce)
+	nonceValue.Store(cryptoNonce)
+}
+
+func (codec *Poly1305AuthCrypto) SetReadNonce(nonce []byte) {
+	codec.setNonce(nonce, &codec.readNonce)
+}
+
+func (codec *Poly1305AuthCrypto) SetWriteNonce(nonce []byte) {
+	codec.setNonce(nonce, &codec.writeNonce)
+}
+
+func NewPoly1305AuthCryptoCodec() *Poly1305AuthCrypto {
+	codec := &Poly1305AuthCrypto{}
+	codec.readNonce.Store(&CryptoNonce{data: make([]byte, 8)})
+	codec.writeNonce.Store(&CryptoNonce{data: make([]byte, 8)})
+	codec.SetKey(InitCryptoKey)
+	codec.SetReadNonce(InitCryptoNonce)
+	codec.SetWriteNonce(InitCryptoNonce)
+	return codec
+}
+
+func (codec *Poly1305AuthCrypto) sum(src []byte, nonce *CryptoNonce, pn uint64) *poly1305.MAC {
+	var nonceBuffer [8]byte
+	var poly1305Key [32]byte
+	salsa20.XORKeyStream(poly1305Key[:], poly1305Key[:], nonce.packetNonce(pn, nonceBuffer[:]), &codec.macKey)
+
+	mac := poly1305.New(&poly1305Key)
+	mac.Write(src[:packetNumberSize])
+	mac.Write(src[protoOffset:])
+	return mac
+}
+
+func (codec *Poly1305AuthCrypto) Encrypt(src []byte) (dst []byte, err error) {
+	if len(src) < int(protoOffset) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	pn := codec.next()
+	binary.LittleEndian.PutUint64(src, pn)
+	codec.sum(src, codec.writeNonce.Load().(*CryptoNonce), pn).Sum(src[macOffset:macOffset])
+	return src, nil
+}
+
+func (codec *Poly1305AuthCrypto) Decrypt(src []byte) (dst []byte, err error) {
+	if len(src) < int(protoOffset) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	pn := binary.LittleEndian.Uint64(src)
+	if !codec.replay.check(pn) {
+		return nil, ErrReplayedPacket
+	}
+
+	if !codec.sum(src, codec.readNonce.Load().(*CryptoNonce), pn).Verify(src[macOffset:protoOffset]) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	if !codec.replay.update(pn) {
+		return nil, ErrReplayedPacket
+	}
+
+	return src[protoOffset:], nil
 }
 
 type CryptoType byte
 
 const (
-	UseChacha20 CryptoType = 0x05
-	UseSalsa20  CryptoType = 0x06
+	UseNoCrypto  CryptoType = 0x00
+	UseChacha20  CryptoType = 0x05
+	UseSalsa20   CryptoType = 0x06
+	UseAES128GCM CryptoType = 0x07
+	UseAES256GCM CryptoType = 0x08
+	UseXChacha20 CryptoType = 0x09
+	// integrity only, no encryption
+	UsePoly1305Auth CryptoType = 0x0A
 )
 
+const aesGCMNonceSize = 12
+
+// factory returns a new codec instance, every connection direction uses its own instance
+type CryptCodecFactory func() CryptCodec
+
+var cryptCodecs = struct {
+	sync.RWMutex
+	factories map[CryptoType]CryptCodecFactory
+}{
+	factories: map[CryptoType]CryptCodecFactory{
+		UseChacha20:     func() CryptCodec { return NewChacha20poly1305CryptoCodec() },
+		UseSalsa20:      func() CryptCodec { return NewSalsa20CryptoCodec() },
+		UseAES128GCM:    func() CryptCodec { return NewAES128GCMCryptoCodec() },
+		UseAES256GCM:    func() CryptCodec { return NewAES256GCMCryptoCodec() },
+		UseXChacha20:    func() CryptCodec { return NewXChacha20poly1305CryptoCodec() },
+		UsePoly1305Auth: func() CryptCodec { return NewPoly1305AuthCryptoCodec() },
+	},
+}
+
+// custom codec MUST keep gouxp packet format:
+// Encrypt gets |---PN---|---MAC---|---PROTO + DATA---|, writes PN and MAC in reserved 24bytes,
+// highest bit of PN MUST be 0, it is key phase. output length MUST be same as input.
+// Decrypt returns PROTO + DATA.
+// codec is checked by a round trip, both sides MUST register same codec with same type
+func RegisterCryptoCodec(tp CryptoType, factory CryptCodecFactory) error {
+	if tp == UseNoCrypto || factory == nil {
+		return ErrInvalidCryptoType
+	}
+
+	err := checkCryptCodec(factory)
+	if err != nil {
+		return err
+	}
+
+	cryptCodecs.Lock()
+	defer cryptCodecs.Unlock()
+
+	if _, ok := cryptCodecs.factories[tp]; ok {
+		return ErrCryptoTypeRegistered
+	}
+
+	cryptCodecs.factories[tp] = factory
+	return nil
+}
+
+func checkCryptCodec(factory CryptCodecFactory) error {
+	encoder, decoder := factory(), factory()
+	if encoder == nil || decoder == nil {
+		return ErrInvalidCryptCodec
+	}
+
+	installSessionKeys(encoder, decoder, InitCryptoKey, InitCryptoNonce, InitCryptoKey, InitCryptoNonce)
+	data := []byte("gouxp crypt codec check")
+	packet := make([]byte, int(protoOffset)+len(data))
+	copy(packet[protoOffset:], data)
+
+	cipherData, err := encoder.Encrypt(packet)
+	if err != nil {
+		return ErrInvalidCryptCodec
+	}
+
+	// MAC MUST fit in reserved header
+	if len(cipherData) != len(packet) || cipherData[keyPhaseOffset]&keyPhaseMask != 0 {
+		return ErrInvalidMACOverhead
+	}
+
+	plaintextData, err := decoder.Decrypt(cipherData)
+	if err != nil || string(plaintextData) != string(data) {
+		return ErrInvalidCryptCodec
+	}
+
+	return nil
+}
+
+// nil if type is unknown
 func createCryptoCodec(tp CryptoType) CryptCodec {
-	switch tp {
-	case UseChacha20:
-		return NewChacha20poly1305CryptoCodec()
-	case UseSalsa20:
-		return NewSalsa20CryptoCodec()
-	default:
+	cryptCodecs.RLock()
+	factory, ok := cryptCodecs.factories[tp]
+	cryptCodecs.RUnlock()
+
+	if !ok {
 		return nil
 	}
+
+	return factory()
 }
 
 func init() {
@@ -1,13 +1,15 @@
 package gouxp
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
 	"testing"
-
-	"github.com/shaoyuan1943/gouxp/dh64"
 )
 
-var macLen = 16
+// packet number and MAC
+var macLen = int(packetNumberSize + macSize)
 
 func checkCrypto(t *testing.T, codec CryptCodec, data []byte) bool {
 	encryptoed, err := codec.Encrypt(data)
@@ -140,9 +142,9 @@ func TestTwoCodec(t *testing.T) {
 
 func TestClientServerCodec(t *testing.T) {
 	clientCodec := createCryptoCodec(UseSalsa20)
-	privateKey, publicKey := dh64.KeyPair()
-	clientData := make([]byte, macLen+8)
-	binary.LittleEndian.PutUint64(clientData[macLen:], publicKey)
+	clientKX, _ := newX25519KeyExchange()
+	clientData := make([]byte, macLen+keyExchangePublicKeySize)
+	copy(clientData[macLen:], clientKX.PublicKey())
 	clientCipherData, err := clientCodec.Encrypt(clientData)
 	if err != nil {
 		t.Fatalf("clientCodec.Encrypto err: %v", err)
@@ -156,14 +158,15 @@ func TestClientServerCodec(t *testing.T) {
 		return
 	}
 
-	clientPublicKey := binary.LittleEndian.Uint64(plaintextData)
-	serverPrivateKey, serverPublicKey := dh64.KeyPair()
-	serverNum := dh64.Secret(serverPrivateKey, clientPublicKey)
-	var serverNonce [8]byte
-	binary.LittleEndian.PutUint64(serverNonce[:], serverNum)
+	serverKX, _ := newX25519KeyExchange()
+	serverNonce, err := serverKX.Secret(plaintextData)
+	if err != nil {
+		t.Fatalf("serverKX.Secret err: %v", err)
+		return
+	}
 
-	serverData := make([]byte, macLen+16)
-	binary.LittleEndian.PutUint64(serverData[macLen:], serverPublicKey)
+	serverData := make([]byte, macLen+keyExchangePublicKeySize)
+	copy(serverData[macLen:], serverKX.PublicKey())
 	serverCipherData, err := serverCodec.Encrypt(serverData)
 	if err != nil {
 		t.Fatalf("serverCodec.Encrypto err: %v", err)
@@ -179,10 +182,11 @@ func TestClientServerCodec(t *testing.T) {
 		return
 	}
 
-	key := binary.LittleEndian.Uint64(serverPlaintextData)
-	clientNum := dh64.Secret(privateKey, key)
-	var clientNonce [8]byte
-	binary.LittleEndian.PutUint64(clientNonce[:], clientNum)
+	clientNonce, err := clientKX.Secret(serverPlaintextData)
+	if err != nil {
+		t.Fatalf("clientKX.Secret err: %v", err)
+		return
+	}
 	clientCodec.SetWriteNonce(clientNonce[:])
 	clientCodec.SetWriteNonce(clientNonce[:])
 
@@ -288,9 +292,9 @@ func TestUnorderCodec(t *testing.T) {
 
 func exchangedCodec(t *testing.T) (CryptCodec, CryptCodec) {
 	clientCodec := createCryptoCodec(UseSalsa20)
-	privateKey, publicKey := dh64.KeyPair()
-	clientData := make([]byte, macLen+8)
-	binary.LittleEndian.PutUint64(clientData[macLen:], publicKey)
+	clientKX, _ := newX25519KeyExchange()
+	clientData := make([]byte, macLen+keyExchangePublicKeySize)
+	copy(clientData[macLen:], clientKX.PublicKey())
 	clientCipherData, err := clientCodec.Encrypt(clientData)
 	if err != nil {
 		t.Fatalf("clientCodec.Encrypto err: %v", err)
@@ -304,14 +308,15 @@ func exchangedCodec(t *testing.T) (CryptCodec, CryptCodec) {
 		return nil, nil
 	}
 
-	clientPublicKey := binary.LittleEndian.Uint64(plaintextData)
-	serverPrivateKey, serverPublicKey := dh64.KeyPair()
-	serverNum := dh64.Secret(serverPrivateKey, clientPublicKey)
-	var serverNonce [8]byte
-	binary.LittleEndian.PutUint64(serverNonce[:], serverNum)
+	serverKX, _ := newX25519KeyExchange()
+	serverNonce, err := serverKX.Secret(plaintextData)
+	if err != nil {
+		t.Fatalf("serverKX.Secret err: %v", err)
+		return nil, nil
+	}
 
-	serverData := make([]byte, macLen+16)
-	binary.LittleEndian.PutUint64(serverData[macLen:], serverPublicKey)
+	serverData := make([]byte, macLen+keyExchangePublicKeySize)
+	copy(serverData[macLen:], serverKX.PublicKey())
 	serverCipherData, err := serverCodec.Encrypt(serverData)
 	if err != nil {
 		t.Fatalf("serverCodec.Encrypto err: %v", err)
@@ -327,12 +332,786 @@ func exchangedCodec(t *testing.T) (CryptCodec, CryptCodec) {
 		return nil, nil
 	}
 
-	key := binary.LittleEndian.Uint64(serverPlaintextData)
-	clientNum := dh64.Secret(privateKey, key)
-	var clientNonce [8]byte
-	binary.LittleEndian.PutUint64(clientNonce[:], clientNum)
+	clientNonce, err := clientKX.Secret(serverPlaintextData)
+	if err != nil {
+		t.Fatalf("clientKX.Secret err: %v", err)
+		return nil, nil
+	}
 	clientCodec.SetWriteNonce(clientNonce[:])
 	clientCodec.SetWriteNonce(clientNonce[:])
 
 	return clientCodec, serverCodec
 }
+
+func TestSessionKeys(t *testing.T) {
+	clientKX, err := newX25519KeyExchange()
+	if err != nil {
+		t.Fatalf("client key exchange err: %v", err)
+	}
+
+	serverKX, err := newX25519KeyExchange()
+	if err != nil {
+		t.Fatalf("server key exchange err: %v", err)
+	}
+
+	clientSecret, err := clientKX.Secret(serverKX.PublicKey())
+	if err != nil {
+		t.Fatalf("client secret err: %v", err)
+	}
+
+	serverSecret, err := serverKX.Secret(clientKX.PublicKey())
+	if err != nil {
+		t.Fatalf("server secret err: %v", err)
+	}
+
+	transcript := append(append([]byte{}, clientKX.PublicKey()...), serverKX.PublicKey()...)
+	clientKeys, err := deriveSessionKeys(clientSecret, transcript)
+	if err != nil {
+		t.Fatalf("client session keys err: %v", err)
+	}
+
+	serverKeys, err := deriveSessionKeys(serverSecret, transcript)
+	if err != nil {
+		t.Fatalf("server session keys err: %v", err)
+	}
+
+	if string(clientKeys.clientKey) == string(clientKeys.serverKey) {
+		t.Fatalf("same key in both directions")
+	}
+
+	for _, tp := range []CryptoType{UseChacha20, UseSalsa20, UseXChacha20} {
+		clientEncoder, clientDecoder := createCryptoCodec(tp), createCryptoCodec(tp)
+		serverEncoder, serverDecoder := createCryptoCodec(tp), createCryptoCodec(tp)
+		installSessionKeys(clientEncoder, clientDecoder, clientKeys.clientKey, clientKeys.clientNonce, clientKeys.serverKey, clientKeys.serverNonce)
+		installSessionKeys(serverEncoder, serverDecoder, serverKeys.serverKey, serverKeys.serverNonce, serverKeys.clientKey, serverKeys.clientNonce)
+
+		data := []byte("fsd34809f43-2fhsdioafhio324h8r1h43fh4389hf9843hf8hsadiofhafh842391h348")
+		testData := make([]byte, len(data)+int(macLen))
+		copy(testData[macLen:], data)
+		cipherData, _ := clientEncoder.Encrypt(testData)
+		plaintextData, err := serverDecoder.Decrypt(cipherData)
+		if err != nil || string(plaintextData) != string(data) {
+			t.Fatalf("server decrypt err: %v", err)
+		}
+
+		// client can't read its own packets
+		testData = make([]byte, len(data)+int(macLen))
+		copy(testData[macLen:], data)
+		cipherData, _ = clientEncoder.Encrypt(testData)
+		if _, err = clientDecoder.Decrypt(cipherData); err == nil {
+			t.Fatalf("client decrypt own packet")
+		}
+	}
+}
+
+func TestRandomPacketNumber(t *testing.T) {
+	var bits uint64
+	for i := 0; i < 64; i++ {
+		bits |= randomPacketNumber()
+	}
+
+	// 62 random bits, key phase is clear
+	if bits != 1<<62-1 {
+		t.Fatalf("random packet number bits: %x", bits)
+	}
+}
+
+func TestReplayCodec(t *testing.T) {
+	for _, tp := range []CryptoType{UseChacha20, UseSalsa20, UseXChacha20} {
+		encoder := createCryptoCodec(tp)
+		decoder := createCryptoCodec(tp)
+
+		data := []byte("sd341348978 fcasdfhuashdfsdpfuh894390ui894")
+		var cipherDatas [][]byte
+		for i := 0; i < replayWindowSize+1; i++ {
+			testData := make([]byte, len(data)+int(macLen))
+			copy(testData[macLen:], data)
+			cipherData, _ := encoder.Encrypt(testData)
+			cipherDatas = append(cipherDatas, append([]byte(nil), cipherData...))
+		}
+
+		if string(cipherDatas[0][macLen:]) == string(cipherDatas[1][macLen:]) {
+			t.Fatalf("same nonce for different packets")
+		}
+
+		// PN is authenticated
+		tampered := append([]byte(nil), cipherDatas[1]...)
+		tampered[0] ^= 0x01
+		if _, err := decoder.Decrypt(tampered); err == nil {
+			t.Fatalf("tampered packet number is accepted")
+		}
+
+		if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[1]...)); err != nil {
+			t.Fatalf("decrypt err: %v", err)
+		}
+
+		if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[1]...)); err != ErrReplayedPacket {
+			t.Fatalf("duplicated packet err: %v", err)
+		}
+
+		// unordered packet in window
+		if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[0]...)); err != nil {
+			t.Fatalf("decrypt unordered err: %v", err)
+		}
+
+		// packets in order within a word, earlier ones are still replayed
+		for i := 2; i < 10; i++ {
+			if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[i]...)); err != nil {
+				t.Fatalf("decrypt packet %v err: %v", i, err)
+			}
+		}
+
+		for i := 0; i < 10; i++ {
+			if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[i]...)); err != ErrReplayedPacket {
+				t.Fatalf("replayed packet %v err: %v", i, err)
+			}
+		}
+
+		if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[replayWindowSize]...)); err != nil {
+			t.Fatalf("decrypt err: %v", err)
+		}
+
+		// too old
+		if _, err := decoder.Decrypt(append([]byte(nil), cipherDatas[2]...)); err != ErrReplayedPacket {
+			t.Fatalf("old packet err: %v", err)
+		}
+	}
+}
+
+func TestAESGCMCodec(t *testing.T) {
+	for _, tp := range []CryptoType{UseAES128GCM, UseAES256GCM} {
+		codec := createCryptoCodec(tp)
+		testCodec(t, codec)
+		codecData(t, createCryptoCodec(tp), createCryptoCodec(tp))
+	}
+}
+
+// | PN | cipher data | MAC |, computed by OpenSSL
+func TestAESGCMKnownAnswer(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	nonce := make([]byte, 12)
+	for i := range nonce {
+		nonce[i] = byte(0x20 + i)
+	}
+
+	data := []byte("gouxp aes-gcm known answer test")
+	answers := map[CryptoType]string{
+		UseAES128GCM: "0807060504030201fd1751aadd203ca5eb28e0a3bf51a213753e3f4441052b43ca2ade596047d93751c03d64853ec938253428469b79ef",
+		UseAES256GCM: "080706050403020111b040f92eae1ae29135e3c80cc8d0637bbba511e3c7093a4e75041b0f0e00e62aba41bb2638315eedfc3e5365f807",
+	}
+
+	for tp, answer := range answers {
+		encoder := createCryptoCodec(tp).(*AESGCMCrypto)
+		encoder.SetKey(key)
+		encoder.SetWriteNonce(nonce)
+		encoder.reset(0x0102030405060708)
+
+		testData := make([]byte, len(data)+int(macLen))
+		copy(testData[macLen:], data)
+		cipherData, err := encoder.Encrypt(testData)
+		if err != nil {
+			t.Fatalf("encoder.Encrypt err: %v", err)
+		}
+
+		expected, _ := hex.DecodeString(answer)
+		if !bytes.Equal(cipherData, expected) {
+			t.Fatalf("crypto type %v cipher data: %x", tp, cipherData)
+		}
+
+		decoder := createCryptoCodec(tp)
+		decoder.SetKey(key)
+		decoder.SetReadNonce(nonce)
+		plaintextData, err := decoder.Decrypt(expected)
+		if err != nil || !bytes.Equal(plaintextData, data) {
+			t.Fatalf("decoder.Decrypt err: %v", err)
+		}
+	}
+}
+
+func TestXChacha20Codec(t *testing.T) {
+	encoder, decoder := createCryptoCodec(UseXChacha20), createCryptoCodec(UseXChacha20)
+	installSessionKeys(encoder, decoder, InitCryptoKey, InitCryptoNonce, InitCryptoKey, make([]byte, sessionNonceSize))
+
+	data := []byte("sd341348978 fcasdfhuashdfsdpfuh894390ui894")
+	seal := func(codec CryptCodec) []byte {
+		testData := make([]byte, len(data)+int(macLen))
+		copy(testData[macLen:], data)
+		cipherData, err := codec.Encrypt(testData)
+		if err != nil || len(cipherData) != len(testData) {
+			t.Fatalf("encrypt err: %v, length: %v", err, len(cipherData))
+		}
+
+		return append([]byte(nil), cipherData...)
+	}
+
+	// nonce is new for every packet and key
+	var nonces [3][maxNonceSize]byte
+	codec := encoder.(*XChacha20poly1305Crypto)
+	codec.nonce.packetNonce(1, nonces[0][:])
+	codec.nonce.packetNonce(2, nonces[1][:])
+	createCryptoCodec(UseXChacha20).(*XChacha20poly1305Crypto).nonce.packetNonce(1, nonces[2][:])
+	if nonces[0] == nonces[1] || nonces[0] != nonces[2] {
+		t.Fatalf("nonce of packet number isn't keyed")
+	}
+
+	installSessionKeys(encoder, encoder, make([]byte, 32), InitCryptoNonce, make([]byte, 32), InitCryptoNonce)
+	codec.nonce.packetNonce(1, nonces[2][:])
+	if nonces[0] == nonces[2] {
+		t.Fatalf("nonce doesn't change with key")
+	}
+
+	// nonce doesn't depend on session nonce or packets before
+	installSessionKeys(encoder, encoder, InitCryptoKey, InitCryptoNonce, InitCryptoKey, InitCryptoNonce)
+	packets := [][]byte{seal(encoder), seal(encoder), seal(encoder)}
+	for _, i := range []int{2, 0} {
+		plaintextData, err := decoder.Decrypt(append([]byte(nil), packets[i]...))
+		if err != nil || !bytes.Equal(plaintextData, data) {
+			t.Fatalf("decrypt packet %v err: %v", i, err)
+		}
+	}
+
+	// PN is authenticated
+	tampered := append([]byte(nil), packets[1]...)
+	tampered[0] ^= 1
+	if _, err := decoder.Decrypt(tampered); err == nil {
+		t.Fatalf("tampered packet number is accepted")
+	}
+
+	if _, err := decoder.Decrypt(packets[1][:protoOffset-1]); err == nil {
+		t.Fatalf("short packet is accepted")
+	}
+}
+
+func TestCryptoNegotiation(t *testing.T) {
+	hello := &clientHello{convID: 1, publicKey: make([]byte, keyExchangePublicKeySize), cryptoTypes: []CryptoType{UseSalsa20, UseChacha20},
+		bufferLen: 4096, mtu: 1400}
+	parsed, data, err := parseClientHello(hello.encode())
+	if err != nil || len(data) != len(hello.encode()) || len(parsed.cryptoTypes) != 2 || parsed.bufferLen != 4096 {
+		t.Fatalf("parseClientHello err: %v", err)
+	}
+
+	// read buffer length is required
+	hello.bufferLen = 0
+	if _, _, err = parseClientHello(hello.encode()); err == nil {
+		t.Fatalf("client hello without read buffer length is accepted")
+	}
+
+	tp, ok := chooseCryptoType([]CryptoType{UseAES256GCM, UseChacha20, UseSalsa20}, parsed.cryptoTypes)
+	if !ok || tp != UseChacha20 {
+		t.Fatalf("chosen crypto type: %v", tp)
+	}
+
+	if _, ok = chooseCryptoType([]CryptoType{UseNoCrypto}, parsed.cryptoTypes); ok {
+		t.Fatalf("no common crypto type is accepted")
+	}
+}
+
+// handshake packet of data type, server can decrypt it but never establishes a connection
+func preSharedKeyPacket(keyID uint32, psk []byte) []byte {
+	encoder, _ := newHandshakeCodecs(psk)
+	cipherData, _ := encoder.Encrypt(handshakePacket(protoTypeData, []byte("hello")))
+	packet := make([]byte, handshakeKeyIDSize)
+	putHandshakeKeyID(packet, keyID)
+	return append(packet, cipherData...)
+}
+
+func TestPreSharedKey(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, preSharedKeySize)
+	newKey := bytes.Repeat([]byte{2}, preSharedKeySize)
+	s := &Server{}
+
+	// default key before any PSK is added
+	if _, err := s.onNewConnection(nil, preSharedKeyPacket(defaultPreSharedKeyID, InitCryptoKey)); err != ErrUnknownProtocolType {
+		t.Fatalf("default key err: %v", err)
+	}
+
+	if s.AddPreSharedKey(defaultPreSharedKeyID, oldKey) != ErrInvalidPreSharedKey || s.AddPreSharedKey(1, oldKey[1:]) != ErrInvalidPreSharedKey {
+		t.Fatalf("invalid PSK is accepted")
+	}
+
+	// rotation: both keys are valid
+	if s.AddPreSharedKey(1, oldKey) != nil || s.AddPreSharedKey(2, newKey) != nil {
+		t.Fatalf("add PSK failed")
+	}
+
+	for keyID, key := range map[uint32][]byte{1: oldKey, 2: newKey} {
+		if _, err := s.onNewConnection(nil, preSharedKeyPacket(keyID, key)); err != ErrUnknownProtocolType {
+			t.Fatalf("key ID %v err: %v", keyID, err)
+		}
+	}
+
+	// unknown and default key ID are rejected
+	for _, keyID := range []uint32{3, defaultPreSharedKeyID} {
+		if _, err := s.onNewConnection(nil, preSharedKeyPacket(keyID, InitCryptoKey)); err != ErrUnknownKeyID {
+			t.Fatalf("key ID %v err: %v", keyID, err)
+		}
+	}
+
+	// key doesn't match key ID
+	if _, err := s.onNewConnection(nil, preSharedKeyPacket(1, newKey)); err == nil || err == ErrUnknownProtocolType {
+		t.Fatalf("wrong key is accepted: %v", err)
+	}
+
+	// removing the last key doesn't fall back to default key
+	s.RemovePreSharedKey(1)
+	if _, err := s.onNewConnection(nil, preSharedKeyPacket(1, oldKey)); err != ErrUnknownKeyID {
+		t.Fatalf("removed key err: %v", err)
+	}
+
+	s.RemovePreSharedKey(2)
+	for keyID, key := range map[uint32][]byte{2: newKey, defaultPreSharedKeyID: InitCryptoKey} {
+		if _, err := s.onNewConnection(nil, preSharedKeyPacket(keyID, key)); err != ErrUnknownKeyID {
+			t.Fatalf("key ID %v err after all keys removed: %v", keyID, err)
+		}
+	}
+
+	client := &ClientConn{}
+	if client.SetPreSharedKey(defaultPreSharedKeyID, oldKey) != ErrInvalidPreSharedKey {
+		t.Fatalf("client accepts default key ID")
+	}
+}
+
+func TestKeyUpdate(t *testing.T) {
+	for _, tp := range []CryptoType{UseChacha20, UseSalsa20, UseAES256GCM, UseXChacha20, UsePoly1305Auth} {
+		keys, err := deriveSessionKeys(make([]byte, keyExchangeSecretSize), []byte("transcript"))
+		if err != nil {
+			t.Fatalf("derive err: %v", err)
+		}
+
+		client, server := &RawConn{}, &RawConn{}
+		clientKeys := keyGeneration{key: keys.clientKey, nonce: keys.clientNonce}
+		serverKeys := keyGeneration{key: keys.serverKey, nonce: keys.serverNonce}
+		client.installSessionCodecs(tp, clientKeys, serverKeys, 0)
+		server.installSessionCodecs(tp, serverKeys, clientKeys, 0)
+		client.keyUpdater.setPolicy(2, 0)
+
+		data := []byte("sd341348978 fcasdfhuashdfsdpfuh894390ui894")
+		seal := func() []byte {
+			testData := make([]byte, len(data)+int(macLen))
+			copy(testData[macLen:], data)
+			cipherData, err := client.encrypt(testData)
+			if err != nil {
+				t.Fatalf("encrypt err: %v", err)
+			}
+
+			return append([]byte(nil), cipherData...)
+		}
+
+		open := func(cipherData []byte) error {
+			plaintextData, err := server.decrypt(cipherData)
+			if err != nil {
+				return err
+			}
+
+			if string(plaintextData) != string(data) {
+				t.Fatalf("decrypt data mismatch")
+			}
+
+			return nil
+		}
+
+		oldPackets := [][]byte{seal(), seal()}
+		// at most once every rekeyMinInterval
+		client.updateRekey(rekeyMinInterval - 1)
+		if client.keyUpdater.writePhase != 0 {
+			t.Fatalf("key updated too early")
+		}
+
+		client.updateRekey(rekeyMinInterval)
+		if client.keyUpdater.writePhase != 1 {
+			t.Fatalf("key isn't updated")
+		}
+
+		newPacket := seal()
+		if newPacket[keyPhaseOffset]&keyPhaseMask == 0 {
+			t.Fatalf("key phase isn't set")
+		}
+
+		if err := open(oldPackets[0]); err != nil {
+			t.Fatalf("decrypt old phase err: %v", err)
+		}
+
+		if err := open(newPacket); err != nil {
+			t.Fatalf("decrypt new phase err: %v", err)
+		}
+
+		// in flight packet of previous phase
+		if err := open(oldPackets[1]); err != nil {
+			t.Fatalf("decrypt in flight packet err: %v", err)
+		}
+
+		if err := open(oldPackets[1]); err != ErrReplayedPacket {
+			t.Fatalf("duplicated packet err: %v", err)
+		}
+
+		// back to phase 0 with third key
+		seal()
+		client.updateRekey(2 * rekeyMinInterval)
+		if err := open(seal()); err != nil {
+			t.Fatalf("decrypt third phase err: %v", err)
+		}
+
+		forged := seal()
+		forged[keyPhaseOffset] ^= keyPhaseMask
+		if err := open(forged); err == nil {
+			t.Fatalf("forged key phase is accepted")
+		}
+	}
+}
+
+// appends MAC instead of using reserved header
+type appendMACCodec struct {
+	*Chacha20poly1305Crypto
+}
+
+func (codec appendMACCodec) Encrypt(src []byte) ([]byte, error) {
+	dst, err := codec.Chacha20poly1305Crypto.Encrypt(src)
+	return append(dst, make([]byte, macSize)...), err
+}
+
+func TestRegisterCryptoCodec(t *testing.T) {
+	customType := CryptoType(0x80)
+	err := RegisterCryptoCodec(customType, func() CryptCodec { return NewChacha20poly1305CryptoCodec() })
+	if err != nil {
+		t.Fatalf("register err: %v", err)
+	}
+
+	if err := RegisterCryptoCodec(customType, func() CryptCodec { return NewSalsa20CryptoCodec() }); err != ErrCryptoTypeRegistered {
+		t.Fatalf("register twice err: %v", err)
+	}
+
+	if err := RegisterCryptoCodec(UseChacha20, func() CryptCodec { return NewSalsa20CryptoCodec() }); err != ErrCryptoTypeRegistered {
+		t.Fatalf("register builtin err: %v", err)
+	}
+
+	if err := RegisterCryptoCodec(UseNoCrypto, func() CryptCodec { return NewSalsa20CryptoCodec() }); err != ErrInvalidCryptoType {
+		t.Fatalf("register no crypto err: %v", err)
+	}
+
+	err = RegisterCryptoCodec(CryptoType(0x81), func() CryptCodec { return appendMACCodec{NewChacha20poly1305CryptoCodec()} })
+	if err != ErrInvalidMACOverhead {
+		t.Fatalf("register invalid MAC err: %v", err)
+	}
+
+	if err := checkCryptoTypes([]CryptoType{customType, CryptoType(0x81)}); err != ErrInvalidCryptoType {
+		t.Fatalf("unregistered type err: %v", err)
+	}
+
+	testCodec(t, createCryptoCodec(customType))
+}
+
+func TestPoly1305AuthCodec(t *testing.T) {
+	encoder := createCryptoCodec(UsePoly1305Auth)
+	decoder := createCryptoCodec(UsePoly1305Auth)
+	testCodec(t, createCryptoCodec(UsePoly1305Auth))
+
+	data := []byte("sd341348978 fcasdfhuashdfsdpfuh894390ui894")
+	testData := make([]byte, len(data)+int(macLen))
+	copy(testData[macLen:], data)
+	cipherData, err := encoder.Encrypt(testData)
+	if err != nil {
+		t.Fatalf("encrypt err: %v", err)
+	}
+
+	// data is plaintext, MAC is filled
+	if !bytes.Equal(cipherData[macLen:], data) || bytes.Equal(cipherData[macOffset:protoOffset], make([]byte, macSize)) {
+		t.Fatalf("invalid packet: %v", cipherData)
+	}
+
+	for _, i := range []int{0, int(macOffset), len(cipherData) - 1} {
+		tampered := append([]byte(nil), cipherData...)
+		tampered[i] ^= 0x01
+		if _, err := decoder.Decrypt(tampered); err == nil {
+			t.Fatalf("tampered byte %v is accepted", i)
+		}
+	}
+
+	plaintextData, err := decoder.Decrypt(append([]byte(nil), cipherData...))
+	if err != nil || !bytes.Equal(plaintextData, data) {
+		t.Fatalf("decrypt err: %v", err)
+	}
+
+	if _, err := decoder.Decrypt(append([]byte(nil), cipherData...)); err != ErrReplayedPacket {
+		t.Fatalf("duplicated packet err: %v", err)
+	}
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	serverKey, serverPublicKey, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatalf("generate key err: %v", err)
+	}
+
+	clientKey, clientPublicKey, _ := GenerateNoiseKey()
+	_, otherPublicKey, _ := GenerateNoiseKey()
+
+	run := func(pattern noisePattern, clientStatic, serverStatic, knownServerKey []byte) (*noiseHandshake, *noiseHandshake, error) {
+		client, err := newNoiseHandshake(pattern, true, clientStatic, knownServerKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		server, err := newNoiseHandshake(pattern, false, serverStatic, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := 0; !client.finished(); i++ {
+			writer, reader := client, server
+			if i%2 == 1 {
+				writer, reader = server, client
+			}
+
+			payload := []byte{byte(i)}
+			message, err := writer.writeMessage(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			got, err := reader.readMessage(message)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("payload mismatch")
+			}
+		}
+
+		return client, server, nil
+	}
+
+	for _, pattern := range []noisePattern{noiseNK, noiseXX} {
+		client, server, err := run(pattern, clientKey, serverKey, serverPublicKey)
+		if err != nil {
+			t.Fatalf("pattern %v handshake err: %v", pattern, err)
+		}
+
+		if !server.finished() {
+			t.Fatalf("pattern %v server isn't finished", pattern)
+		}
+
+		clientKeys, err := client.sessionKeys()
+		if err != nil {
+			t.Fatalf("pattern %v client session keys err: %v", pattern, err)
+		}
+
+		serverKeys, err := server.sessionKeys()
+		if err != nil {
+			t.Fatalf("pattern %v server session keys err: %v", pattern, err)
+		}
+
+		if !bytes.Equal(clientKeys.clientKey, serverKeys.clientKey) || !bytes.Equal(clientKeys.serverNonce, serverKeys.serverNonce) {
+			t.Fatalf("pattern %v session keys mismatch", pattern)
+		}
+
+		if bytes.Equal(clientKeys.clientKey, clientKeys.serverKey) {
+			t.Fatalf("pattern %v same key for both directions", pattern)
+		}
+
+		if pattern == noiseXX && (!bytes.Equal(client.rs, serverPublicKey) || !bytes.Equal(server.rs, clientPublicKey)) {
+			t.Fatalf("static keys mismatch")
+		}
+	}
+
+	// NK client knows wrong server key
+	if _, _, err := run(noiseNK, nil, serverKey, otherPublicKey); err != ErrNoiseHandshakeFailed {
+		t.Fatalf("wrong server key err: %v", err)
+	}
+
+	// tampered message
+	client, _ := newNoiseHandshake(noiseXX, true, clientKey, nil)
+	server, _ := newNoiseHandshake(noiseXX, false, serverKey, nil)
+	message, _ := client.writeMessage(nil)
+	server.readMessage(message)
+	message, _ = server.writeMessage(nil)
+	message[len(message)-1] ^= 0x01
+	if _, err := client.readMessage(message); err != ErrNoiseHandshakeFailed {
+		t.Fatalf("tampered message err: %v", err)
+	}
+}
+
+func TestPendingNoise(t *testing.T) {
+	s := &Server{}
+	now := uint32(10000)
+	addr := func(i int) net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: i} }
+	for i := 0; i < maxPendingNoise; i++ {
+		s.addPendingNoise(addr(i), &pendingNoise{createTime: now + uint32(i/16)})
+	}
+
+	// full table evicts the oldest handshake instead of dropping new one
+	s.addPendingNoise(addr(maxPendingNoise), &pendingNoise{createTime: now + 64})
+	if len(s.pendingNoise) != maxPendingNoise || s.pendingNoise[addr(maxPendingNoise).String()] == nil {
+		t.Fatalf("new handshake is dropped")
+	}
+
+	for i := 16; i < maxPendingNoise; i++ {
+		if s.pendingNoise[addr(i).String()] == nil {
+			t.Fatalf("handshake %v isn't the oldest but evicted", i)
+		}
+	}
+
+	// same address replaces its handshake without eviction
+	s.addPendingNoise(addr(maxPendingNoise), &pendingNoise{createTime: now + 64})
+	if len(s.pendingNoise) != maxPendingNoise {
+		t.Fatalf("pending handshakes: %v", len(s.pendingNoise))
+	}
+
+	// expired handshakes are removed, half of them are older than timeout
+	s.addPendingNoise(addr(0), &pendingNoise{createTime: now + noisePendingTimeout + 32})
+	if len(s.pendingNoise) != maxPendingNoise/2+2 {
+		t.Fatalf("pending handshakes after expiration: %v", len(s.pendingNoise))
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	hello := &clientHello{convID: 1, publicKey: make([]byte, keyExchangePublicKeySize), cryptoTypes: []CryptoType{UseChacha20},
+		bufferLen: 4096, mtu: 1400}
+	hello.identity = &ClientIdentity{KeyType: ClientKeyEd25519, PublicKey: publicKey}
+	data := hello.encode()
+	signed := data[:len(data)-identitySignatureSize]
+	copy(data[len(signed):], signClientIdentity(privateKey, signed))
+
+	parsed, helloData, err := parseClientHello(data)
+	if err != nil || parsed.identity == nil || !bytes.Equal(helloData, data) {
+		t.Fatalf("parse client hello err: %v", err)
+	}
+
+	if !verifyClientIdentity(parsed.identity.PublicKey, helloData[:len(helloData)-identitySignatureSize], parsed.signature) {
+		t.Fatalf("verify client identity failed")
+	}
+
+	// signature covers crypto types
+	data[clientHelloMinSize] = byte(UseSalsa20)
+	if verifyClientIdentity(parsed.identity.PublicKey, helloData[:len(helloData)-identitySignatureSize], parsed.signature) {
+		t.Fatalf("tampered client hello is accepted")
+	}
+
+	keyring := func(identity *ClientIdentity) bool { return bytes.Equal(identity.PublicKey, publicKey) }
+	if checkClientIdentity(keyring, nil) || !checkClientIdentity(nil, nil) || !checkClientIdentity(keyring, parsed.identity) {
+		t.Fatalf("check client identity failed")
+	}
+}
+
+func TestServerIdentity(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	s := &Server{}
+	client := &ClientConn{}
+	if s.SetIdentityKey(privateKey[:ed25519.SeedSize]) != ErrInvalidIdentityKey || client.TrustServerKeys(publicKey, publicKey[1:]) != ErrInvalidIdentityKey {
+		t.Fatalf("invalid identity key is accepted")
+	}
+
+	if s.SetIdentityKey(privateKey) != nil || client.TrustServerKeys(otherKey, publicKey) != nil {
+		t.Fatalf("set identity key failed")
+	}
+
+	hello := &clientHello{convID: 1, publicKey: make([]byte, keyExchangePublicKeySize), cryptoTypes: []CryptoType{UseChacha20},
+		bufferLen: 4096, mtu: 1400}
+	client.cryptoTypes = hello.cryptoTypes
+	client.handshakeData = hello.encode()
+	rsp := &serverHello{publicKey: make([]byte, keyExchangePublicKeySize), status: handshakeStatusAccepted, cryptoType: UseChacha20,
+		bufferLen: 4096}
+	rspData := rsp.encode()
+	copy(rspData[serverHelloSignedSize:], signIdentity(s.identityKey, client.handshakeData, rspData[:serverHelloSignedSize]))
+
+	// any key in trust list verifies
+	signature := rspData[serverHelloSignedSize:]
+	if err := verifyIdentity(client.trustedKeys, client.handshakeData, rspData[:serverHelloSignedSize], signature); err != nil {
+		t.Fatalf("verify identity err: %v", err)
+	}
+
+	// server key isn't trusted
+	client.trustedKeys = []ed25519.PublicKey{otherKey}
+	if err := client.onHandshake(rspData); err != ErrServerAuthFailed {
+		t.Fatalf("untrusted server err: %v", err)
+	}
+
+	client.trustedKeys = []ed25519.PublicKey{publicKey}
+
+	// tampered signature
+	tampered := append([]byte(nil), rspData...)
+	tampered[serverHelloSignedSize] ^= 1
+	if err := client.onHandshake(tampered); err != ErrServerAuthFailed {
+		t.Fatalf("tampered signature err: %v", err)
+	}
+
+	// signature covers server hello and client hello
+	tampered = append([]byte(nil), rspData...)
+	tampered[0] ^= 1
+	if err := client.onHandshake(tampered); err != ErrServerAuthFailed {
+		t.Fatalf("tampered server hello err: %v", err)
+	}
+
+	if err := verifyIdentity(client.trustedKeys, client.handshakeData[1:], rspData[:serverHelloSignedSize], signature); err != ErrServerAuthFailed {
+		t.Fatalf("replayed signature err: %v", err)
+	}
+
+	if err := verifyIdentity(client.trustedKeys, client.handshakeData, rspData[:serverHelloSignedSize], signature[:identitySignatureSize-1]); err != ErrServerAuthFailed {
+		t.Fatalf("short signature err: %v", err)
+	}
+}
+
+func TestHandshakeConfirm(t *testing.T) {
+	kx, err := newX25519KeyExchange()
+	if err != nil {
+		t.Fatalf("key exchange err: %v", err)
+	}
+
+	hello := &clientHello{convID: 1, publicKey: kx.PublicKey(), cryptoTypes: []CryptoType{UseChacha20, UseNoCrypto}, bufferLen: 4096, mtu: 1400}
+	client := &ClientConn{keyExchange: kx, cryptoTypes: hello.cryptoTypes, handshakeData: hello.encode()}
+	accept := func(tp CryptoType, helloData []byte) []byte {
+		rsp := &serverHello{status: handshakeStatusAccepted, cryptoType: tp, bufferLen: 4096}
+		rspData, _, err := serverKeyExchange(rsp, hello.publicKey, helloData)
+		if err != nil {
+			t.Fatalf("server key exchange err: %v", err)
+		}
+
+		return rspData
+	}
+
+	// both sides derive same keys, also without crypto
+	for _, tp := range []CryptoType{UseChacha20, UseNoCrypto} {
+		rspData := accept(tp, client.handshakeData)
+		rsp, err := parseServerHello(rspData)
+		if err != nil {
+			t.Fatalf("parse server hello err: %v", err)
+		}
+
+		if _, err = client.confirmSessionKeys(rsp, rspData); err != nil {
+			t.Fatalf("confirm session keys err: %v", err)
+		}
+	}
+
+	// crypto types offered by client are stripped on the way
+	stripped := *hello
+	stripped.cryptoTypes = []CryptoType{UseNoCrypto}
+	if err = client.onHandshake(accept(UseNoCrypto, stripped.encode())); err != ErrHandshakeConfirmFailed {
+		t.Fatalf("stripped client hello err: %v", err)
+	}
+
+	// crypto type chosen by server is changed on the way
+	rspData := accept(UseChacha20, client.handshakeData)
+	rspData[keyExchangePublicKeySize+1] = byte(UseNoCrypto)
+	if err = client.onHandshake(rspData); err != ErrHandshakeConfirmFailed {
+		t.Fatalf("downgraded server hello err: %v", err)
+	}
+
+	// key confirmation is changed on the way
+	rspData = accept(UseNoCrypto, client.handshakeData)
+	rspData[serverHelloConfirmOffset] ^= 1
+	if err = client.onHandshake(rspData); err != ErrHandshakeConfirmFailed {
+		t.Fatalf("tampered key confirmation err: %v", err)
+	}
+
+	// invalid crypto type is reported
+	s := &Server{}
+	if s.UseCryptoCodec(CryptoType(0xFF)) != ErrInvalidCryptoType || client.UseCryptoCodec(CryptoType(0xFF)) != ErrInvalidCryptoType {
+		t.Fatalf("invalid crypto type is accepted")
+	}
+}
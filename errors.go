@@ -3,13 +3,36 @@ package gouxp
 import "github.com/pkg/errors"
 
 var (
-	ErrConnClosed          = errors.New("connection is closed")
-	ErrDifferentAddr       = errors.New("different remote addr")
-	ErrMessageAuthFailed   = errors.New("message authentication failed")
-	ErrHeartbeatTimeout    = errors.New("conn heartbeat timeout")
-	ErrInvalidNonceSize    = errors.New("invalid nonce size")
-	ErrTryAgain            = errors.New("try again")
-	ErrWriteDataTooLong    = errors.New("write data too long")
-	ErrUnknownProtocolType = errors.New("unknown protocol type")
-	ErrExistConnection     = errors.New("exist connection")
+	ErrConnClosed              = errors.New("connection is closed")
+	ErrDifferentAddr           = errors.New("different remote addr")
+	ErrMessageAuthFailed       = errors.New("message authentication failed")
+	ErrHeartbeatTimeout        = errors.New("conn heartbeat timeout")
+	ErrInvalidNonceSize        = errors.New("invalid nonce size")
+	ErrTryAgain                = errors.New("try again")
+	ErrWriteDataTooLong        = errors.New("write data too long")
+	ErrUnknownProtocolType     = errors.New("unknown protocol type")
+	ErrExistConnection         = errors.New("exist connection")
+	ErrInvalidMTUProbe         = errors.New("invalid mtu probe")
+	ErrDeadLink                = errors.New("dead link")
+	ErrInvalidControl          = errors.New("invalid control message")
+	ErrInvalidPublicKey        = errors.New("invalid public key")
+	ErrReplayedPacket          = errors.New("replayed packet")
+	ErrInvalidPreSharedKey     = errors.New("invalid pre-shared key")
+	ErrUnknownKeyID            = errors.New("unknown pre-shared key id")
+	ErrInvalidIdentityKey      = errors.New("invalid identity key")
+	ErrServerAuthFailed        = errors.New("server identity authentication failed")
+	ErrInvalidCryptoType       = errors.New("invalid crypto type")
+	ErrCryptoNegotiationFailed = errors.New("no crypto type supported by both sides")
+	ErrCryptoTypeRegistered    = errors.New("crypto type is registered")
+	ErrInvalidCryptCodec       = errors.New("invalid crypt codec")
+	ErrInvalidMACOverhead      = errors.New("crypt codec MAC doesn't fit reserved size")
+	ErrInvalidNoiseKey         = errors.New("invalid noise static key")
+	ErrNoiseHandshakeFailed    = errors.New("noise handshake failed")
+	ErrClientAuthFailed        = errors.New("client identity authentication failed")
+	ErrInvalidCompression      = errors.New("invalid compression type")
+	ErrCompressionRegistered   = errors.New("compression type is registered")
+	ErrDecompressedTooLong     = errors.New("decompressed data too long")
+	ErrInvalidCompressionDict  = errors.New("invalid compression dictionary")
+	ErrNoCompressionDict       = errors.New("no compression dictionary agreed in handshake")
+	ErrHandshakeConfirmFailed  = errors.New("handshake key confirmation failed")
 )
@@ -0,0 +1,286 @@
+package gouxp
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// adaptive FEC:
+// receiver counts FEC shards it gets against shards sent by group numbers, and data shards
+// recovered by parity, then reports loss and recovery rate once a second while sender asks.
+// sender with adaptive FEC asks for reports once a second, receiver stops reporting when it
+// isn't asked for fecReportTimeout.
+// sender changes parity shard count of next group between bounds by reported loss, data shard
+// count isn't changed. KCP retransmission rate of sender is taken as loss if it is larger, only
+// when parity is off and reported loss isn't clean, delayed ACKs cause retransmission too.
+// group flushed before it is full is counted by data shard count in its parity shards.
+// fec report: | header: 26bytes | cmd: 2bytes | loss: 2bytes | recovery: 2bytes |
+// fec report ask: | header: 26bytes | cmd: 2bytes |
+// rates are in 1/10000
+const (
+	fecReportInterval = 1000
+	fecReportTimeout  = 3 * fecReportInterval
+	fecReportSize     = 6
+	fecRateScale      = 10000
+	// less loss is treated as clean link
+	fecCleanLoss = 0.005
+	// parity covers twice the expected loss of a group
+	fecLossMargin = 2.0
+	// parity isn't enough when less lost shards are recovered
+	fecRecoveryTarget = 0.9
+	// larger gap of group number means sender is restarted, it isn't counted as loss
+	fecMaxGroupGap = 1024
+)
+
+// receiver side, shards are counted in read loop and reported in update loop.
+// newest group is still coming, it is counted when next group comes
+type fecStats struct {
+	mx           sync.Mutex
+	started      bool
+	maxGroup     uint32
+	maxShards    int
+	maxData      int
+	pending      int
+	pendingData  int
+	expected     int
+	received     int
+	expectedData int
+	receivedData int
+	recovered    int
+}
+
+// next group counts shards of newest group and of skipped groups as expected
+func (s *fecStats) onShard(group uint32, dataShards, shards int, data bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	gap := int32(group - s.maxGroup)
+	if !s.started || gap > fecMaxGroupGap {
+		s.started = true
+		s.maxGroup, s.maxShards, s.maxData = group, shards, dataShards
+		s.pending, s.pendingData = 0, 0
+		gap = 0
+	}
+
+	if gap < 0 {
+		s.received++
+		if data {
+			s.receivedData++
+		}
+
+		return
+	}
+
+	if gap > 0 {
+		s.expected += s.maxShards + int(gap-1)*shards
+		s.expectedData += s.maxData + int(gap-1)*dataShards
+		s.received += s.pending
+		s.receivedData += s.pendingData
+		s.maxGroup, s.maxShards, s.maxData = group, shards, dataShards
+		s.pending, s.pendingData = 0, 0
+	}
+
+	s.pending++
+	if data {
+		s.pendingData++
+	}
+}
+
+// parity shards tell data shard count of group flushed before it is full
+func (s *fecStats) onPartialGroup(group uint32, dataShards, shards int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.started && group == s.maxGroup {
+		s.maxShards, s.maxData = shards, dataShards
+	}
+}
+
+func (s *fecStats) onRecovered(n int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.recovered += n
+}
+
+// rates since last take, ok is false if nothing is received
+func (s *fecStats) take() (loss, recovery float64, ok bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.expected == 0 {
+		return 0, 0, false
+	}
+
+	// late shards of previous window
+	if lost := s.expected - s.received; lost > 0 {
+		loss = float64(lost) / float64(s.expected)
+	}
+
+	recovery = 1
+	if lost := s.expectedData - s.receivedData; lost > 0 {
+		recovery = math.Min(float64(s.recovered)/float64(lost), 1)
+	}
+
+	s.expected, s.received, s.expectedData, s.receivedData, s.recovered = 0, 0, 0, 0, 0
+	return loss, recovery, true
+}
+
+type fecAdapter struct {
+	enabled      bool
+	minParity    int
+	maxParity    int
+	configParity int
+	// KCP push segments since last report
+	nextSN        uint32
+	sent          int
+	retransmitted int
+	askTime       uint32
+	// receiver side
+	asked      bool
+	askedTime  uint32
+	reportTime uint32
+}
+
+func (a *fecAdapter) onOutput(data []byte) {
+	eachKCPSegment(data, func(h kcpSegmentHeader) {
+		if h.cmd != gokcp.KCP_CMD_PUSH {
+			return
+		}
+
+		a.sent++
+		if int32(h.sn-a.nextSN) < 0 {
+			a.retransmitted++
+		} else {
+			a.nextSN = h.sn + 1
+		}
+	})
+}
+
+// parity shard count for next groups, it goes down one by one to avoid flapping
+func (a *fecAdapter) parityShards(loss, recovery float64, dataShards, current int) int {
+	if current == 0 && loss >= fecCleanLoss && a.sent > 0 {
+		loss = math.Max(loss, float64(a.retransmitted)/float64(a.sent))
+	}
+
+	a.sent, a.retransmitted = 0, 0
+	target := a.maxParity
+	if loss < fecCleanLoss {
+		target = a.minParity
+	} else {
+		for p := a.minParity; p <= a.maxParity; p++ {
+			if float64(p) >= fecLossMargin*loss*float64(dataShards+p) {
+				target = p
+				break
+			}
+		}
+	}
+
+	if current > 0 && loss >= fecCleanLoss && recovery < fecRecoveryTarget && target <= current {
+		target = current + 1
+	}
+
+	if target < current {
+		target = current - 1
+	}
+
+	return a.clampParity(target)
+}
+
+func (a *fecAdapter) clampParity(parityShards int) int {
+	if parityShards < a.minParity {
+		return a.minParity
+	} else if parityShards > a.maxParity {
+		return a.maxParity
+	}
+
+	return parityShards
+}
+
+// invoke in update loop, conn is locked
+func (conn *RawConn) updateFECReport(now uint32) error {
+	a := &conn.fecAdapter
+	if a.enabled && conn.fecEncoder != nil && now-a.askTime >= fecReportInterval {
+		a.askTime = now
+		var buffer [PacketHeaderSize + 2]byte
+		binary.LittleEndian.PutUint16(buffer[PacketHeaderSize:], controlCmdFECReportAsk)
+		err := conn.sendControl(buffer[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.asked && now-a.askedTime >= fecReportTimeout {
+		a.asked = false
+	}
+
+	if !a.asked || conn.fecDecoder == nil || now-a.reportTime < fecReportInterval {
+		return nil
+	}
+
+	a.reportTime = now
+	loss, recovery, ok := conn.fecDecoder.stats.take()
+	if !ok {
+		return nil
+	}
+
+	var buffer [PacketHeaderSize + fecReportSize]byte
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize:], controlCmdFECReport)
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize+2:], uint16(loss*fecRateScale))
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize+4:], uint16(recovery*fecRateScale))
+	return conn.sendControl(buffer[:])
+}
+
+// remote wants loss reports, shards counted before it asks aren't reported
+func (conn *RawConn) onFECReportAsk() error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.fecDecoder == nil {
+		return nil
+	}
+
+	a := &conn.fecAdapter
+	now := gokcp.SetupFromNowMS()
+	if !a.asked {
+		a.asked = true
+		a.reportTime = now
+		conn.fecDecoder.stats.take()
+	}
+
+	a.askedTime = now
+	return nil
+}
+
+// remote reports loss of packets we sent
+func (conn *RawConn) onFECReport(data []byte) error {
+	if len(data) < fecReportSize {
+		return ErrInvalidControl
+	}
+
+	loss := float64(binary.LittleEndian.Uint16(data[2:])) / fecRateScale
+	recovery := float64(binary.LittleEndian.Uint16(data[4:])) / fecRateScale
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	a := &conn.fecAdapter
+	if !a.enabled || conn.fecEncoder == nil {
+		return nil
+	}
+
+	parityShards := a.parityShards(loss, recovery, conn.fecEncoder.dataShards, conn.fecEncoder.nextParity)
+	if parityShards != conn.fecEncoder.nextParity {
+		if logger != nil {
+			logger.Infof("conn %v fec parity shards: %v -> %v, loss: %.4f, recovery: %.4f",
+				conn.ID(), conn.fecEncoder.nextParity, parityShards, loss, recovery)
+		}
+
+		return conn.fecEncoder.setParityShards(parityShards)
+	}
+
+	return nil
+}
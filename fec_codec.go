@@ -12,16 +12,26 @@ import (
 )
 
 // fec packet format:
-// |   sn  |  cmd  |  len  | payload |
-// | 4byte | 2byte | 2byte |   ...   |
-// sn: packet sequence id
+// | group | cmd   | count | index | parity |  len  | payload |
+// | 4byte | 1byte | 1byte | 1byte | 1byte  | 2byte |   ...   |
+// group: group number, increases by one each group
 // cmd: flag data or parity
+// count: data shard count of group in parity shards, it is less than data shards when group is
+// flushed before it is full. 0 in data shards
+// index: shard index in group, parity shards follow data shards
+// parity: parity shard count of group, it may change between groups.
+// 0 means data shards are sent one by one without parity
 // len: payload length
+// data shards are sent at once, parity shards are sent when group is full or flushed
 
 // define
 const (
 	FECDataShards   = 3
 	FECParityShards = 2
+	// every shard of a group is buffered by decoder
+	maxFECShards = 64
+	// parity of partial group is sent after it(ms)
+	defaultFECFlushTimeout = 20
 )
 
 // cmd
@@ -32,20 +42,28 @@ const (
 
 const (
 	fecResultSize  = 50
-	fecDataTimeout = 10000 // 10min
+	fecDataTimeout = 10000 // 10s
+	// groups kept by decoder, MUST be power of 2
+	fecRingSize = 128
 )
 
 // format
 const (
+	fecCmdOffset    = 4
+	fecCountOffset  = 5
+	fecIndexOffset  = 6
+	fecParityOffset = 7
 	fecLengthOffset = 2
-	fecHeaderOffset = 6
+	fecHeaderOffset = 8
 	fecHeaderSize   = fecHeaderOffset + fecLengthOffset
 )
 
 var (
-	ErrUnknownFecCmd  = errors.New("unknown fec cmd")
-	ErrFecDataTimeout = errors.New("fec data timeout")
-	ErrNoFecData      = errors.New("no fec data")
+	ErrUnknownFecCmd    = errors.New("unknown fec cmd")
+	ErrFecDataTimeout   = errors.New("fec data timeout")
+	ErrNoFecData        = errors.New("no fec data")
+	ErrFecDataTooLong   = errors.New("fec data too long")
+	ErrInvalidFecConfig = errors.New("invalid fec config")
 )
 
 var fecBufferPool sync.Pool
@@ -59,6 +77,10 @@ func bufferFromPool(size int) []byte {
 	}
 
 	buffer := fecBufferPool.Get().([]byte)
+	if cap(buffer) < size {
+		buffer = make([]byte, size)
+	}
+
 	buffer = buffer[:0]
 	return buffer
 }
@@ -69,167 +91,365 @@ func bufferBackPool(buffer []byte) {
 	}
 }
 
+// FEC shards agreed in handshake, 0 data shards means FEC is off
+type fecConfig struct {
+	dataShards   int
+	parityShards int
+}
+
+// client asks for its shards, server's are used if client doesn't ask or they don't fit,
+// no FEC if neither fits
+func chooseFECConfig(server, client fecConfig, mtu, bufferLen int) fecConfig {
+	if client.dataShards > 0 && checkFECConfig(client.dataShards, client.parityShards, mtu, bufferLen) == nil {
+		return client
+	}
+
+	if checkFECConfig(server.dataShards, server.parityShards, mtu, bufferLen) == nil {
+		return server
+	}
+
+	return fecConfig{}
+}
+
+// every shard carries a whole KCP packet with FEC header, it MUST fit read buffer
+func checkFECConfig(dataShards, parityShards, mtu, bufferLen int) error {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > maxFECShards {
+		return ErrInvalidFecConfig
+	}
+
+	if bufferLen > 0 && mtu+fecHeaderSize >= bufferLen {
+		return ErrInvalidFecConfig
+	}
+
+	return nil
+}
+
+// largest KCP packet FEC shard carries in handshake, server conn starts with KCP default MTU.
+// both sides check shards chosen in handshake with it, so they agree on FEC
+func fecHandshakeMTU(clientMTU int) int {
+	mtu := int(gokcp.KCP_MTU_DEF)
+	if clientMTU > mtu {
+		return clientMTU
+	}
+
+	return mtu
+}
+
+// shards are sent both ways, they MUST fit the smaller read buffer
+func fecBufferLen(bufferLen, remoteBufferLen int) int {
+	if remoteBufferLen < bufferLen {
+		return remoteBufferLen
+	}
+
+	return bufferLen
+}
+
 func isFECFormat(data []byte) bool {
-	if data == nil || len(data) <= 0 {
+	if len(data) < fecHeaderSize {
 		return false
 	}
 
-	fecCmd := binary.LittleEndian.Uint16(data[4:])
-	if int(fecCmd) != fecCmdData && int(fecCmd) != fecCmdParity {
+	fecCmd := data[fecCmdOffset]
+	if fecCmd != fecCmdData && fecCmd != fecCmdParity {
 		return false
 	}
 
-	return true
+	return data[fecCountOffset] < maxFECShards && data[fecIndexOffset] < maxFECShards && data[fecParityOffset] < maxFECShards
+}
+
+// codec of each parity shard count, nil for 0
+type fecCodecs struct {
+	dataShards int
+	codecs     map[int]reedsolomon.Encoder
+}
+
+func (c *fecCodecs) codec(parityShards int) (reedsolomon.Encoder, error) {
+	if parityShards == 0 {
+		return nil, nil
+	}
+
+	if codec, ok := c.codecs[parityShards]; ok {
+		return codec, nil
+	}
+
+	codec, err := reedsolomon.New(c.dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.codecs == nil {
+		c.codecs = make(map[int]reedsolomon.Encoder)
+	}
+
+	c.codecs[parityShards] = codec
+	return codec, nil
 }
 
 type FecCodecEncoder struct {
-	codec          reedsolomon.Encoder
-	q              [][]byte
-	insertIndex    int
-	nextSN         int32
-	shards         int
-	dataShards     int
-	parityShards   int
-	maxRawDataLen  int
-	zero           []byte
-	codecData      [][]byte
-	offset         int
-	bufferSize     int
-	lastInsertTime uint32
-}
-
-func NewFecEncoder(dataShards, parityShards, bufferSize int) *FecCodecEncoder {
+	codecs        fecCodecs
+	q             [][]byte
+	insertIndex   int
+	group         uint32
+	shards        int
+	dataShards    int
+	parityShards  int
+	nextParity    int
+	maxRawDataLen int
+	zero          []byte
+	codecData     [][]byte
+	bufferSize    int
+	result        [][]byte
+	// first data shard of group
+	groupTime uint32
+}
+
+func NewFecEncoder(dataShards, parityShards int, bufferSize int) *FecCodecEncoder {
 	fecEncoder := &FecCodecEncoder{}
-	fecEncoder.shards = dataShards + parityShards
 	fecEncoder.dataShards = dataShards
-	fecEncoder.parityShards = parityShards
-	encoder, err := reedsolomon.New(fecEncoder.dataShards, fecEncoder.parityShards)
+	fecEncoder.codecs.dataShards = dataShards
+	fecEncoder.bufferSize = bufferSize
+	fecEncoder.zero = make([]byte, bufferSize)
+	err := fecEncoder.setParityShards(parityShards)
 	if err != nil {
 		panic(fmt.Sprintf("init fec encoder: %v", err))
 	}
 
-	fecEncoder.codec = encoder
-	fecEncoder.codecData = make([][]byte, fecEncoder.shards)
-	fecEncoder.bufferSize = bufferSize
-	fecEncoder.zero = make([]byte, bufferSize)
-	fecEncoder.q = make([][]byte, fecEncoder.shards)
-	for i := 0; i < fecEncoder.shards; i++ {
-		fecEncoder.q[i] = make([]byte, bufferSize)
-		fecEncoder.q[i] = fecEncoder.q[i][:0]
+	return fecEncoder
+}
+
+// new parity shard count is used from next group
+func (f *FecCodecEncoder) setParityShards(parityShards int) error {
+	if parityShards < 0 || f.dataShards+parityShards > maxFECShards {
+		return ErrInvalidFecConfig
 	}
 
-	return fecEncoder
+	if _, err := f.codecs.codec(parityShards); err != nil {
+		return err
+	}
+
+	f.nextParity = parityShards
+	if f.insertIndex == 0 {
+		f.applyParityShards()
+	}
+
+	return nil
+}
+
+func (f *FecCodecEncoder) applyParityShards() {
+	f.parityShards = f.nextParity
+	f.shards = f.dataShards + f.parityShards
+	for len(f.q) < f.shards {
+		f.q = append(f.q, make([]byte, 0, f.bufferSize))
+	}
+
+	if len(f.codecData) < f.shards {
+		f.codecData = make([][]byte, f.shards)
+	}
 }
 
+// grow buffer when MTU grows, queued data is kept
+func (f *FecCodecEncoder) setBufferSize(bufferSize int) {
+	if bufferSize <= f.bufferSize {
+		return
+	}
+
+	for i := 0; i < len(f.q); i++ {
+		buffer := make([]byte, len(f.q[i]), bufferSize)
+		copy(buffer, f.q[i])
+		f.q[i] = buffer
+	}
+
+	f.zero = make([]byte, bufferSize)
+	f.bufferSize = bufferSize
+}
+
+// data shard is returned at once, parity shards follow it when group is full
 func (f *FecCodecEncoder) Encode(rawData []byte) (fecData [][]byte, err error) {
 	if rawData == nil || len(rawData) == 0 || len(rawData) > f.bufferSize {
 		panic("raw data length invalid")
 	}
 
 	n := len(rawData)
-	f.q[f.insertIndex] = f.q[f.insertIndex][:fecHeaderSize+n]
-	copy(f.q[f.insertIndex][fecHeaderSize:], rawData)
-	binary.LittleEndian.PutUint16(f.q[f.insertIndex][fecHeaderOffset:], uint16(n))
-	f.lastInsertTime = gokcp.SetupFromNowMS()
+	index := f.insertIndex
+	f.q[index] = f.q[index][:fecHeaderSize+n]
+	copy(f.q[index][fecHeaderSize:], rawData)
+	binary.LittleEndian.PutUint16(f.q[index][fecHeaderOffset:], uint16(n))
+	f.markData(f.q[index], index)
+	if index == 0 {
+		f.groupTime = gokcp.SetupFromNowMS()
+	}
 
 	if n > f.maxRawDataLen {
 		f.maxRawDataLen = n
 	}
 
-	if (f.insertIndex + 1) == f.dataShards {
-		maxLen := f.maxRawDataLen + fecHeaderSize
-		for i := 0; i < (f.dataShards + f.parityShards); i++ {
-			if i >= f.dataShards {
-				f.q[i] = f.q[i][:maxLen]
-				f.codecData[i] = f.q[i][fecHeaderOffset:maxLen]
-			} else {
-				orgLen := len(f.q[i])
-				if orgLen < maxLen {
-					f.q[i] = f.q[i][:maxLen]
-					copy(f.q[i][orgLen:maxLen], f.zero)
-				}
-
-				f.codecData[i] = f.q[i][fecHeaderOffset:maxLen]
-			}
-		}
+	f.insertIndex++
+	f.result = append(f.result[:0], f.q[index])
+	if f.insertIndex < f.dataShards {
+		return f.result, nil
+	}
 
-		err = f.codec.Encode(f.codecData)
-		if err != nil {
-			return
+	// no parity, group is only counted by receiver
+	if f.parityShards == 0 {
+		f.nextGroup()
+		return f.result, nil
+	}
+
+	return f.encodeParity()
+}
+
+// data shards are queued, parity of them isn't sent
+func (f *FecCodecEncoder) pending() bool {
+	return f.insertIndex > 0 && f.parityShards > 0
+}
+
+// parity shards of partial group, data shards after it go to next group
+func (f *FecCodecEncoder) Flush() (fecData [][]byte, err error) {
+	if !f.pending() {
+		return nil, nil
+	}
+
+	f.result = f.result[:0]
+	return f.encodeParity()
+}
+
+// data shards are sent, they are padded to the longest one in place. missing data shards of
+// partial group are zero
+func (f *FecCodecEncoder) encodeParity() (fecData [][]byte, err error) {
+	count := f.insertIndex
+	maxLen := f.maxRawDataLen + fecHeaderSize
+	for i := 0; i < f.shards; i++ {
+		orgLen := len(f.q[i])
+		if i >= count {
+			orgLen = 0
 		}
 
-		for i := 0; i < (f.dataShards + f.parityShards); i++ {
-			if i >= f.dataShards {
-				f.markParity(f.q[i])
-			} else {
-				f.markData(f.q[i])
-			}
+		f.q[i] = f.q[i][:maxLen]
+		if i < f.dataShards && orgLen < maxLen {
+			copy(f.q[i][orgLen:maxLen], f.zero)
 		}
 
-		f.insertIndex = 0
-		f.maxRawDataLen = 0
+		f.codecData[i] = f.q[i][fecHeaderOffset:maxLen]
+	}
 
-		fecData = f.q
-		err = nil
+	codec, _ := f.codecs.codec(f.parityShards)
+	err = codec.Encode(f.codecData[:f.shards])
+	if err != nil {
 		return
 	}
 
-	f.insertIndex++
-	return
+	for i := f.dataShards; i < f.shards; i++ {
+		f.markParity(f.q[i], i, count)
+	}
+
+	f.result = append(f.result, f.q[f.dataShards:f.shards]...)
+	f.nextGroup()
+	return f.result, nil
 }
 
-func (f *FecCodecEncoder) markData(data []byte) {
-	binary.LittleEndian.PutUint32(data[:4], uint32(f.nextSN))
-	binary.LittleEndian.PutUint16(data[4:fecHeaderOffset], uint16(fecCmdData))
-	f.nextSN++
+func (f *FecCodecEncoder) nextGroup() {
+	f.insertIndex = 0
+	f.maxRawDataLen = 0
+	f.group++
+	f.applyParityShards()
 }
 
-func (f *FecCodecEncoder) markParity(data []byte) {
-	binary.LittleEndian.PutUint32(data[:4], uint32(f.nextSN))
-	binary.LittleEndian.PutUint16(data[4:fecHeaderOffset], uint16(fecCmdParity))
-	f.nextSN++
+func (f *FecCodecEncoder) markHeader(data []byte, cmd byte, count, index int) {
+	binary.LittleEndian.PutUint32(data, f.group)
+	data[fecCmdOffset] = cmd
+	data[fecCountOffset] = byte(count)
+	data[fecIndexOffset] = byte(index)
+	data[fecParityOffset] = byte(f.parityShards)
 }
 
+func (f *FecCodecEncoder) markData(data []byte, index int) {
+	f.markHeader(data, fecCmdData, 0, index)
+}
+
+func (f *FecCodecEncoder) markParity(data []byte, index, count int) {
+	f.markHeader(data, fecCmdParity, count, index)
+}
+
+// slot of decoder ring, shards are released when group is decoded or slot is reused
 type DataShards struct {
-	q             [][]byte
-	o             [][]byte
-	lastInsert    uint32
-	insertIndex   int
-	decoded       bool
-	maxRawDataLen int
-	shardsCount   int
+	group        uint32
+	used         bool
+	decoded      bool
+	q            [][]byte
+	lastInsert   uint32
+	shardsCount  int
+	parityShards int
+	// known by parity shard, 0 before it comes
+	dataCount int
+	dataRecvd int
+	parityLen int
+}
+
+func (ds *DataShards) reset(group uint32, parityShards, shards int) {
+	ds.release()
+	ds.group, ds.used, ds.decoded = group, true, false
+	ds.parityShards = parityShards
+	ds.shardsCount, ds.dataCount, ds.dataRecvd, ds.parityLen = 0, 0, 0, 0
+	if cap(ds.q) < shards {
+		ds.q = make([][]byte, shards, maxFECShards)
+	}
+
+	ds.q = ds.q[:shards]
 }
 
+func (ds *DataShards) release() {
+	for i := 0; i < len(ds.q); i++ {
+		if ds.q[i] != nil {
+			bufferBackPool(ds.q[i])
+			ds.q[i] = nil
+		}
+	}
+}
+
+// groups are in a ring indexed by group number, newest group and fecRingSize-1 groups before it
+// are kept. older groups are dropped when newer ones come, so at most fecRingSize groups of
+// maxFECShards shards are buffered
 type FecCodecDecoder struct {
-	codec        reedsolomon.Encoder
-	shards       int
+	codecs       fecCodecs
 	dataShards   int
 	parityShards int
-	rawData      map[int]DataShards
+	ring         []DataShards
+	started      bool
+	maxGroup     uint32
+	codecData    [][]byte
+	zero         []byte
 	result       [][]byte
-	offset       int
 	bufferSize   int
+	stats        fecStats
 }
 
 func NewFecDecoder(dataShards, parityShards, bufferSize int) *FecCodecDecoder {
 	fecDecoder := &FecCodecDecoder{}
-	fecDecoder.shards = dataShards + parityShards
 	fecDecoder.dataShards = dataShards
 	fecDecoder.parityShards = parityShards
-	decoder, err := reedsolomon.New(dataShards, parityShards)
-	if err != nil {
+	fecDecoder.codecs.dataShards = dataShards
+	if _, err := fecDecoder.codecs.codec(parityShards); err != nil {
 		panic(fmt.Sprintf("init fec decoder err: %v", err))
 	}
 
-	fecDecoder.codec = decoder
-	fecDecoder.rawData = make(map[int]DataShards)
+	fecDecoder.ring = make([]DataShards, fecRingSize)
+	fecDecoder.codecData = make([][]byte, maxFECShards)
+	fecDecoder.zero = make([]byte, bufferSize)
 	fecDecoder.result = make([][]byte, fecResultSize)
 	fecDecoder.bufferSize = bufferSize
 	return fecDecoder
 }
 
+func (f *FecCodecDecoder) setBufferSize(bufferSize int) {
+	if bufferSize > f.bufferSize {
+		f.zero = make([]byte, bufferSize)
+		f.bufferSize = bufferSize
+	}
+}
+
+// data shard is returned at once, lost data shards are returned when group can be reconstructed
 func (f *FecCodecDecoder) Decode(fecData []byte, now uint32) (rawData [][]byte, err error) {
-	if fecData == nil || len(fecData) == 0 || len(fecData) > f.bufferSize {
+	if fecData == nil || len(fecData) == 0 {
 		panic("raw data length invalid")
 	}
 
@@ -237,103 +457,200 @@ func (f *FecCodecDecoder) Decode(fecData []byte, now uint32) (rawData [][]byte,
 		return nil, ErrUnknownFecCmd
 	}
 
-	sn := binary.LittleEndian.Uint32(fecData)
-	startRange := int(sn) - (int(sn) % f.shards)
-	endRange := startRange + f.shards + 1
-	sumIndex := 0
-	for i := startRange; i < endRange; i++ {
-		sumIndex += i
+	if len(fecData) > f.bufferSize {
+		return nil, ErrFecDataTooLong
+	}
+
+	group := binary.LittleEndian.Uint32(fecData)
+	index := int(fecData[fecIndexOffset])
+	count := int(fecData[fecCountOffset])
+	parityShards := int(fecData[fecParityOffset])
+	shards := f.dataShards + parityShards
+	isData := fecData[fecCmdOffset] == fecCmdData
+	if index >= shards || shards > maxFECShards || isData != (index < f.dataShards) || count > f.dataShards ||
+		(!isData && count == 0) {
+		return nil, ErrUnknownFecCmd
 	}
 
-	ds, ok := f.rawData[sumIndex]
-	if !ok {
-		ds = DataShards{}
-		ds.o = make([][]byte, f.shards)
-		ds.q = make([][]byte, f.shards)
-		for i := 0; i < len(ds.q); i++ {
-			ds.o[i] = bufferFromPool(f.bufferSize)
-			ds.q[i] = ds.o[i]
+	if isData {
+		n := int(binary.LittleEndian.Uint16(fecData[fecHeaderOffset:]))
+		if fecHeaderSize+n > len(fecData) {
+			return nil, ErrUnknownFecCmd
 		}
 	}
 
-	ds.q[int(sn)-startRange] = ds.q[int(sn)-startRange][:len(fecData)]
-	copy(ds.q[int(sn)-startRange], fecData)
-	ds.shardsCount++
+	f.result = f.result[:0]
+	f.stats.onShard(group, f.dataShards, shards, isData)
+	if !isData && count < f.dataShards {
+		f.stats.onPartialGroup(group, count, count+parityShards)
+	}
 
-	if len(fecData) > ds.maxRawDataLen {
-		ds.maxRawDataLen = len(fecData)
+	// no parity, data shard is sent alone
+	if parityShards == 0 {
+		return f.appendData(fecData), nil
 	}
 
-	ds.lastInsert = now
-	f.rawData[sumIndex] = ds
+	// too old to be reconstructed, data shard is still delivered
+	ds := f.slot(group, now)
+	if ds == nil {
+		if isData {
+			f.appendData(fecData)
+		}
 
-	f.result = f.result[:0]
-	for k, v := range f.rawData {
-		if v.decoded {
-			f.delShards(k)
-			continue
+		return f.result, nil
+	}
+
+	if !ds.used {
+		ds.reset(group, parityShards, shards)
+	}
+
+	// duplicated shard or shard of other layout
+	if ds.parityShards != parityShards || ds.decoded || ds.q[index] != nil {
+		return nil, nil
+	}
+
+	if !isData {
+		if ds.dataCount != 0 && (ds.dataCount != count || ds.parityLen != len(fecData)) {
+			return nil, nil
 		}
 
-		if len(f.result) >= fecResultSize || len(f.result)+f.dataShards >= fecResultSize {
-			break
+		ds.dataCount, ds.parityLen = count, len(fecData)
+	}
+
+	ds.q[index] = bufferFromPool(f.bufferSize)[:len(fecData)]
+	copy(ds.q[index], fecData)
+	ds.shardsCount++
+	ds.lastInsert = now
+	if isData {
+		ds.dataRecvd++
+		f.appendData(fecData)
+	}
+
+	f.reconstruct(ds)
+
+	// decoded group keeps its slot without shards, late shards of it are dropped
+	if ds.decoded {
+		ds.release()
+	}
+
+	return f.result, nil
+}
+
+// slot of group, nil if group is older than ring. slots passed by newest group are dropped,
+// groups without enough shards are dropped after timeout. much older group means remote
+// encoder is restarted
+func (f *FecCodecDecoder) slot(group uint32, now uint32) *DataShards {
+	// serial number arithmetic, group number wraps around
+	diff := int32(group - f.maxGroup)
+	if !f.started || diff >= fecRingSize || diff <= -fecMaxGroupGap {
+		f.started = true
+		f.maxGroup = group
+		f.clear()
+	} else if diff > 0 {
+		for g := f.maxGroup + 1; g != group+1; g++ {
+			f.drop(g)
 		}
 
-		if v.shardsCount >= f.dataShards {
-			codec := v.q
-			for i := 0; i < len(v.q); i++ {
-				d := v.q[i]
-				if len(d) > 0 {
-					sn = binary.LittleEndian.Uint32(d)
-					startRange = int(sn) - (int(sn) % f.shards)
-					codec[(int(sn) - startRange)] = d[fecHeaderOffset:]
-				}
-			}
+		f.maxGroup = group
+	} else if diff <= -fecRingSize {
+		return nil
+	}
 
-			err = f.codec.ReconstructData(codec)
-			if err != nil {
-				return
-			}
+	ds := &f.ring[group&(fecRingSize-1)]
+	if ds.used && (ds.group != group || now-ds.lastInsert > fecDataTimeout) {
+		f.drop(ds.group)
+	}
+
+	return ds
+}
+
+func (f *FecCodecDecoder) drop(group uint32) {
+	ds := &f.ring[group&(fecRingSize-1)]
+	ds.release()
+	ds.used = false
+}
+
+func (f *FecCodecDecoder) clear() {
+	for i := 0; i < len(f.ring); i++ {
+		f.ring[i].release()
+		f.ring[i].used = false
+	}
+}
+
+func (f *FecCodecDecoder) appendData(data []byte) [][]byte {
+	n := int(binary.LittleEndian.Uint16(data[fecHeaderOffset:]))
+	f.result = append(f.result, data[fecHeaderSize:fecHeaderSize+n])
+	return f.result
+}
 
-			reconstructed := codec[:f.dataShards]
-			for i := 0; i < len(reconstructed); i++ {
-				n := binary.LittleEndian.Uint16(reconstructed[i])
-				if n > 0 {
-					reconstructed[i] = reconstructed[i][fecLengthOffset:]
-					reconstructed[i] = reconstructed[i][:n]
-				}
+// group is done when all data shards come, or lost ones are recovered by parity.
+// data shards are padded to parity length, missing data shards of partial group are zero
+func (f *FecCodecDecoder) reconstruct(ds *DataShards) {
+	if ds.dataCount == 0 {
+		return
+	}
+
+	if ds.dataRecvd >= ds.dataCount {
+		ds.decoded = true
+		return
+	}
+
+	if ds.shardsCount < ds.dataCount {
+		return
+	}
+
+	codec := f.codecData[:len(ds.q)]
+	lost := 0
+	for i := 0; i < len(ds.q); i++ {
+		d := ds.q[i]
+		if i < f.dataShards && i >= ds.dataCount {
+			codec[i] = f.zero[fecHeaderOffset:ds.parityLen]
+			continue
+		}
+
+		if d == nil {
+			codec[i] = nil
+			if i < f.dataShards {
+				lost++
 			}
 
-			v.decoded = true
-			f.result = append(f.result, reconstructed...)
-			f.rawData[k] = v
 			continue
 		}
 
-		// timeout
-		if (now-v.lastInsert) > fecDataTimeout && !v.decoded {
-			f.delShards(k)
+		orgLen := len(d)
+		if cap(d) < ds.parityLen {
+			d = append(make([]byte, 0, ds.parityLen), d...)
+			bufferBackPool(ds.q[i])
 		}
-	}
 
-	rawData = f.result
-	err = nil
-	return
-}
+		d = d[:ds.parityLen]
+		for j := orgLen; j < ds.parityLen; j++ {
+			d[j] = 0
+		}
+
+		ds.q[i] = d
+		codec[i] = d[fecHeaderOffset:]
+	}
 
-func (f *FecCodecDecoder) delShards(sumIndex int) {
-	ds, ok := f.rawData[sumIndex]
-	if !ok {
+	// corrupt group is done without recovered shards, data shards already returned are kept
+	ds.decoded = true
+	rs, _ := f.codecs.codec(ds.parityShards)
+	if rs.ReconstructData(codec) != nil {
 		return
 	}
 
-	for i := 0; i < f.shards; i++ {
-		if ds.o[i] != nil {
-			bufferBackPool(ds.o[i])
+	for i := 0; i < ds.dataCount; i++ {
+		if ds.q[i] == nil && fecLengthOffset+int(binary.LittleEndian.Uint16(codec[i])) > len(codec[i]) {
+			return
 		}
 	}
 
-	ds.q = nil
-	ds.o = nil
+	for i := 0; i < ds.dataCount; i++ {
+		if ds.q[i] == nil {
+			n := int(binary.LittleEndian.Uint16(codec[i]))
+			f.result = append(f.result, codec[i][fecLengthOffset:fecLengthOffset+n])
+		}
+	}
 
-	delete(f.rawData, sumIndex)
+	f.stats.onRecovered(lost)
 }
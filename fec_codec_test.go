@@ -2,7 +2,9 @@ package gouxp
 
 import (
 	"encoding/binary"
+	"math"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
@@ -155,3 +157,491 @@ func TestFecCodec(t *testing.T) {
 		}
 	}
 }
+
+func TestFecConfig(t *testing.T) {
+	if checkFECConfig(0, 1, 1400, 0) != ErrInvalidFecConfig || checkFECConfig(60, 5, 1400, 0) != ErrInvalidFecConfig ||
+		checkFECConfig(10, 3, 1400, 1400) != ErrInvalidFecConfig || checkFECConfig(10, 3, 1400, 4096) != nil {
+		t.Fatalf("check fec config failed")
+	}
+
+	conn := &RawConn{bufferLen: 4096}
+	conn.initKCP(1, defaultKCPProfile)
+	conn.reconfigurer.established = true
+	if err := conn.EnableFECWithConfig(10, 3); err != nil || conn.fecEncoder.dataShards != 10 || conn.fecDecoder.parityShards != 3 {
+		t.Fatalf("enable fec err: %v", err)
+	}
+
+	if err := conn.EnableFECWithConfig(2, 0); err != ErrInvalidFecConfig || conn.fecEncoder.dataShards != 10 {
+		t.Fatalf("invalid fec config err: %v", err)
+	}
+
+	// group of 10+3 survives 3 lost packets
+	bufferSize := int(conn.kcp.MTU()) + fecHeaderSize
+	encoder, decoder := NewFecEncoder(10, 3, bufferSize), NewFecDecoder(10, 3, bufferSize)
+	var fecData [][]byte
+	for i := 0; i < 10; i++ {
+		data, err := encoder.Encode([]byte{byte(i), 1, 2, 3})
+		if err != nil {
+			t.Fatalf("encode err: %v", err)
+		}
+
+		fecData = append(fecData, data...)
+	}
+
+	var rawData [][]byte
+	for i, v := range fecData {
+		if i == 1 || i == 4 || i == 8 {
+			continue
+		}
+
+		data, err := decoder.Decode(v, gokcp.SetupFromNowMS())
+		if err != nil {
+			t.Fatalf("decode err: %v", err)
+		}
+
+		rawData = append(rawData, data...)
+	}
+
+	// received data shards come at once, lost ones are recovered
+	if len(rawData) != 10 || rawData[7][0] != 1 || rawData[8][0] != 4 || rawData[9][0] != 8 {
+		t.Fatalf("reconstruct failed: %v", len(rawData))
+	}
+}
+
+func TestAdaptiveFEC(t *testing.T) {
+	encoder, decoder := NewFecEncoder(4, 2, 1024), NewFecDecoder(4, 2, 1024)
+	encode := func(i int) [][]byte {
+		fecData, err := encoder.Encode([]byte{byte(i), 1, 2, 3})
+		if err != nil {
+			t.Fatalf("encode err: %v", err)
+		}
+
+		return fecData
+	}
+
+	// new parity is used from next group
+	encode(0)
+	encoder.setParityShards(0)
+	if encoder.parityShards != 2 {
+		t.Fatalf("parity changed in group")
+	}
+
+	for i := 1; i < 4; i++ {
+		encode(i)
+	}
+
+	if encoder.parityShards != 0 {
+		t.Fatalf("parity isn't changed")
+	}
+
+	// without parity data shard is sent and received at once
+	fecData := encode(4)
+	if len(fecData) != 1 || fecData[0][fecParityOffset] != 0 {
+		t.Fatalf("data shard isn't sent at once")
+	}
+
+	rawData, err := decoder.Decode(fecData[0], gokcp.SetupFromNowMS())
+	if err != nil || len(rawData) != 1 || rawData[0][0] != 4 {
+		t.Fatalf("data shard isn't received at once, err: %v", err)
+	}
+
+	// group 2 is lost, a data shard of group 3 is recovered
+	for i := 5; i < 8; i++ {
+		encode(i)
+	}
+
+	encoder.setParityShards(3)
+	for i := 8; i < 12; i++ {
+		encode(i)
+	}
+
+	var group [][]byte
+	for i := 12; i < 16; i++ {
+		group = append(group, encode(i)...)
+	}
+
+	if len(group) != 7 || binary.LittleEndian.Uint32(group[0]) != 3 {
+		t.Fatalf("group layout invalid: %v", len(group))
+	}
+
+	rawData = nil
+	for i, v := range group {
+		if i == 1 {
+			continue
+		}
+
+		data, err := decoder.Decode(v, gokcp.SetupFromNowMS())
+		if err != nil {
+			t.Fatalf("decode err: %v", err)
+		}
+
+		rawData = append(rawData, data...)
+	}
+
+	if len(rawData) != 4 || rawData[3][0] != 13 || decoder.stats.recovered != 1 {
+		t.Fatalf("reconstruct failed")
+	}
+
+	// group 1 is lost, a data shard of group 2 is lost and recovered, group 3 is still coming
+	stats := &fecStats{}
+	for i := 0; i < 6; i++ {
+		stats.onShard(0, 4, 6, i < 4)
+	}
+
+	for i := 0; i < 6; i++ {
+		if i != 2 {
+			stats.onShard(2, 4, 6, i < 4)
+		}
+	}
+
+	stats.onShard(3, 4, 6, true)
+	stats.onRecovered(1)
+	loss, recovery, ok := stats.take()
+	if !ok || loss != 7.0/18 || recovery != 0.2 {
+		t.Fatalf("loss: %v, recovery: %v", loss, recovery)
+	}
+
+	a := &fecAdapter{enabled: true, minParity: 0, maxParity: 6}
+	if p := a.parityShards(0.001, 1, 10, 0); p != 0 {
+		t.Fatalf("clean link parity: %v", p)
+	}
+
+	if p := a.parityShards(0.1, 1, 10, 0); p != 3 {
+		t.Fatalf("10%% loss parity: %v", p)
+	}
+
+	if p := a.parityShards(0.1, 0.5, 10, 3); p != 4 {
+		t.Fatalf("low recovery parity: %v", p)
+	}
+
+	if p := a.parityShards(0.5, 1, 10, 4); p != 6 {
+		t.Fatalf("max parity: %v", p)
+	}
+
+	if p := a.parityShards(0, 1, 10, 6); p != 5 {
+		t.Fatalf("parity goes down one by one: %v", p)
+	}
+
+	// KCP retransmission is loss too without parity on lossy link
+	a.sent, a.retransmitted = 100, 10
+	if p := a.parityShards(0.01, 1, 10, 0); p != 3 {
+		t.Fatalf("retransmission parity: %v", p)
+	}
+
+	a.sent, a.retransmitted = 100, 10
+	if p := a.parityShards(0, 1, 10, 0); p != 0 {
+		t.Fatalf("retransmission on clean link: %v", p)
+	}
+
+	a.sent, a.retransmitted = 100, 10
+	if p := a.parityShards(0, 1, 10, 3); p != 2 {
+		t.Fatalf("retransmission with parity: %v", p)
+	}
+}
+
+func TestAdaptiveFECOutput(t *testing.T) {
+	rwc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+
+	defer rwc.Close()
+
+	keys, _ := deriveSessionKeys(make([]byte, keyExchangeSecretSize), []byte("transcript"))
+	conn := &RawConn{bufferLen: 4096, rwc: rwc, addr: rwc.LocalAddr()}
+	conn.initKCP(1, defaultKCPProfile)
+	conn.installSessionCodecs(UseChacha20, keyGeneration{key: keys.clientKey, nonce: keys.clientNonce},
+		keyGeneration{key: keys.serverKey, nonce: keys.serverNonce}, 0)
+	if err = conn.SetCompression(UseZstd); err != nil {
+		t.Fatalf("set compression err: %v", err)
+	}
+
+	conn.enableFEC(fecConfig{dataShards: 4, parityShards: 2})
+	if err = conn.EnableAdaptiveFEC(0, 2); err != nil {
+		t.Fatalf("enable adaptive fec err: %v", err)
+	}
+
+	// push segment and its retransmission, both compressed and encrypted
+	segment := func() []byte {
+		data := make([]byte, int(PacketHeaderSize)+int(gokcp.KCP_OVERHEAD)+512)
+		data[PacketHeaderSize+4] = byte(gokcp.KCP_CMD_PUSH)
+		binary.LittleEndian.PutUint32(data[PacketHeaderSize+12:], 7)
+		binary.LittleEndian.PutUint32(data[PacketHeaderSize+20:], 512)
+		return data
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = conn.sendKCPData(segment()); err != nil {
+			t.Fatalf("send err: %v", err)
+		}
+	}
+
+	if conn.fecAdapter.sent != 2 || conn.fecAdapter.retransmitted != 1 {
+		t.Fatalf("sent: %v, retransmitted: %v", conn.fecAdapter.sent, conn.fecAdapter.retransmitted)
+	}
+}
+
+func TestFECNegotiation(t *testing.T) {
+	hello := &clientHello{convID: 1, publicKey: make([]byte, keyExchangePublicKeySize), cryptoTypes: []CryptoType{UseChacha20},
+		fec: fecConfig{dataShards: 10, parityShards: 3}, bufferLen: 4096, mtu: 1400}
+	parsed, _, err := parseClientHello(hello.encode())
+	if err != nil || parsed.fec != hello.fec || parsed.mtu != hello.mtu {
+		t.Fatalf("parse client hello err: %v", err)
+	}
+
+	rsp := &serverHello{publicKey: make([]byte, keyExchangePublicKeySize), cryptoType: UseChacha20, fec: parsed.fec, bufferLen: 2048}
+	parsedRsp, err := parseServerHello(rsp.encode())
+	if err != nil || parsedRsp.fec != rsp.fec || parsedRsp.bufferLen != rsp.bufferLen {
+		t.Fatalf("parse server hello err: %v", err)
+	}
+
+	if _, err = parseFECConfig([]byte{0, 3}); err == nil {
+		t.Fatalf("parity without data shards is accepted")
+	}
+
+	// client shards are used if they are valid, or server's
+	server := fecConfig{dataShards: 4, parityShards: 2}
+	if cfg := chooseFECConfig(server, parsed.fec, 1400, 4096); cfg != parsed.fec {
+		t.Fatalf("client fec config isn't chosen: %v", cfg)
+	}
+
+	if cfg := chooseFECConfig(server, fecConfig{}, 1400, 4096); cfg != server {
+		t.Fatalf("server fec config isn't chosen: %v", cfg)
+	}
+
+	if cfg := chooseFECConfig(server, fecConfig{dataShards: 60, parityShards: 10}, 1400, 4096); cfg != server {
+		t.Fatalf("invalid client fec config is chosen: %v", cfg)
+	}
+
+	// shards of larger MTU MUST fit both read buffers, or no FEC
+	if mtu := fecHandshakeMTU(1000); mtu != int(gokcp.KCP_MTU_DEF) {
+		t.Fatalf("fec handshake MTU: %v", mtu)
+	}
+
+	if cfg := chooseFECConfig(server, parsed.fec, fecHandshakeMTU(1500), fecBufferLen(4096, 1500)); cfg != (fecConfig{}) {
+		t.Fatalf("fec config doesn't fit read buffer: %v", cfg)
+	}
+
+	client := &ClientConn{}
+	client.bufferLen = 4096
+	client.initKCP(1, defaultKCPProfile)
+	if cfg := client.checkFECConfig(server, 4096); cfg != server {
+		t.Fatalf("client rejects fec config: %v", cfg)
+	}
+
+	if cfg := client.checkFECConfig(server, 1400); cfg != (fecConfig{}) {
+		t.Fatalf("client accepts fec config doesn't fit read buffer: %v", cfg)
+	}
+
+	// FEC is enabled when handshake is done, adaptive bounds are kept
+	conn := &RawConn{bufferLen: 4096}
+	conn.initKCP(1, defaultKCPProfile)
+	if err = conn.EnableFECWithConfig(10, 3); err != nil || conn.fecEncoder != nil {
+		t.Fatalf("fec is enabled before handshake, err: %v", err)
+	}
+
+	if err = conn.EnableAdaptiveFEC(0, 2); err != nil {
+		t.Fatalf("enable adaptive fec err: %v", err)
+	}
+
+	conn.enableFEC(server)
+	if conn.fecEncoder.dataShards != 4 || conn.fecEncoder.parityShards != 2 || !conn.fecAdapter.enabled {
+		t.Fatalf("negotiated fec isn't enabled")
+	}
+}
+
+func TestFECReportAsk(t *testing.T) {
+	conn := &RawConn{bufferLen: 4096}
+	conn.initKCP(1, defaultKCPProfile)
+	conn.enableFEC(fecConfig{dataShards: 4, parityShards: 2})
+	conn.fecDecoder.stats.onShard(0, 4, 6, true)
+	conn.fecDecoder.stats.onShard(1, 4, 6, true)
+
+	// receiver doesn't report until remote asks, conn without socket panics if it sends
+	now := gokcp.SetupFromNowMS()
+	if err := conn.updateFECReport(now + fecReportInterval); err != nil || conn.fecAdapter.asked {
+		t.Fatalf("report isn't asked, err: %v", err)
+	}
+
+	if err := conn.onFECReportAsk(); err != nil || !conn.fecAdapter.asked {
+		t.Fatalf("report ask err: %v", err)
+	}
+
+	if _, _, ok := conn.fecDecoder.stats.take(); ok {
+		t.Fatalf("shards before ask are reported")
+	}
+
+	if err := conn.updateFECReport(conn.fecAdapter.askedTime + fecReportTimeout); err != nil || conn.fecAdapter.asked {
+		t.Fatalf("report isn't stopped, err: %v", err)
+	}
+}
+
+func TestFecFlush(t *testing.T) {
+	encoder, decoder := NewFecEncoder(4, 2, 1024), NewFecDecoder(4, 2, 1024)
+	var shards [][]byte
+	for i := 0; i < 2; i++ {
+		fecData, err := encoder.Encode([]byte{byte(i), 1, 2, 3})
+		if err != nil || len(fecData) != 1 {
+			t.Fatalf("data shard isn't sent at once, err: %v", err)
+		}
+
+		shards = append(shards, append([]byte(nil), fecData[0]...))
+	}
+
+	// parity of partial group, next packet starts next group
+	fecData, err := encoder.Flush()
+	if err != nil || len(fecData) != 2 || fecData[0][fecCountOffset] != 2 || encoder.pending() {
+		t.Fatalf("flush err: %v", err)
+	}
+
+	shards = append(shards, fecData...)
+	if fecData, _ = encoder.Flush(); fecData != nil {
+		t.Fatalf("empty group is flushed")
+	}
+
+	fecData, _ = encoder.Encode([]byte{2, 1, 2, 3})
+	if binary.LittleEndian.Uint32(fecData[0]) != 1 || fecData[0][fecIndexOffset] != 0 {
+		t.Fatalf("flushed group is reused")
+	}
+
+	// data shard 1 is lost and recovered by one parity shard
+	var rawData [][]byte
+	for _, i := range []int{0, 2, 3} {
+		data, err := decoder.Decode(shards[i], gokcp.SetupFromNowMS())
+		if err != nil {
+			t.Fatalf("decode err: %v", err)
+		}
+
+		rawData = append(rawData, data...)
+	}
+
+	if len(rawData) != 2 || rawData[0][0] != 0 || rawData[1][0] != 1 || len(rawData[1]) != 4 {
+		t.Fatalf("partial group isn't recovered: %v", len(rawData))
+	}
+}
+
+func TestFecCorruptGroup(t *testing.T) {
+	encoder, decoder := NewFecEncoder(4, 2, 1024), NewFecDecoder(4, 2, 1024)
+	var shards [][]byte
+	for i := 0; i < 4; i++ {
+		fecData, err := encoder.Encode([]byte{byte(i), 1, 2, 3})
+		if err != nil {
+			t.Fatalf("encode err: %v", err)
+		}
+
+		for _, v := range fecData {
+			shards = append(shards, append([]byte(nil), v...))
+		}
+	}
+
+	// corrupt parity recovers data shard 3 with invalid length, group is dropped
+	shards[4][fecHeaderOffset] ^= 0xFF
+	shards[4][fecHeaderOffset+1] ^= 0xFF
+	var rawData [][]byte
+	for _, i := range []int{0, 1, 4, 2, 3} {
+		data, err := decoder.Decode(shards[i], gokcp.SetupFromNowMS())
+		if err != nil {
+			t.Fatalf("decode shard %v err: %v", i, err)
+		}
+
+		rawData = append(rawData, data...)
+	}
+
+	if len(rawData) != 3 || rawData[2][0] != 2 || decoder.stats.recovered != 0 {
+		t.Fatalf("data shards of corrupt group: %v", len(rawData))
+	}
+}
+
+func TestFecDecoderRing(t *testing.T) {
+	encoder, decoder := NewFecEncoder(4, 2, 1024), NewFecDecoder(4, 2, 1024)
+	now := gokcp.SetupFromNowMS()
+
+	// group number wraps around, data shard 1 of each group is lost and recovered
+	encoder.group = math.MaxUint32 - 2
+	var groups [][][]byte
+	for g := 0; g < 6; g++ {
+		var group [][]byte
+		for i := 0; i < 4; i++ {
+			fecData, err := encoder.Encode([]byte{byte(g), byte(i)})
+			if err != nil {
+				t.Fatalf("encode err: %v", err)
+			}
+
+			for _, v := range fecData {
+				group = append(group, append([]byte(nil), v...))
+			}
+		}
+
+		groups = append(groups, group)
+	}
+
+	recovered := 0
+	for g, group := range groups {
+		for i, v := range group {
+			if i == 1 {
+				continue
+			}
+
+			rawData, err := decoder.Decode(v, now)
+			if err != nil {
+				t.Fatalf("decode err: %v", err)
+			}
+
+			for _, data := range rawData {
+				if data[0] == byte(g) && data[1] == 1 {
+					recovered++
+				}
+			}
+		}
+	}
+
+	if recovered != 6 || decoder.maxGroup != 2 {
+		t.Fatalf("recovered: %v, max group: %v", recovered, decoder.maxGroup)
+	}
+
+	// groups without enough shards are bounded by ring
+	parity := groups[0][4]
+	for g := uint32(3); g < 1003; g++ {
+		binary.LittleEndian.PutUint32(parity, g)
+		decoder.Decode(parity, now)
+	}
+
+	used := 0
+	for i := range decoder.ring {
+		if decoder.ring[i].used {
+			used++
+		}
+	}
+
+	if used != fecRingSize || decoder.maxGroup != 1002 {
+		t.Fatalf("ring used: %v, max group: %v", used, decoder.maxGroup)
+	}
+
+	// data shard older than ring is still delivered, parity of it is dropped
+	data := groups[0][0]
+	binary.LittleEndian.PutUint32(data, 800)
+	if rawData, _ := decoder.Decode(data, now); len(rawData) != 1 {
+		t.Fatalf("old data shard is dropped")
+	}
+
+	binary.LittleEndian.PutUint32(parity, 800)
+	if rawData, _ := decoder.Decode(parity, now); len(rawData) != 0 || decoder.ring[800&(fecRingSize-1)].group != 928 {
+		t.Fatalf("old parity shard is buffered")
+	}
+
+	// stale group is dropped after timeout
+	binary.LittleEndian.PutUint32(data, 1000)
+	decoder.Decode(data, now+fecDataTimeout+1)
+	if ds := decoder.ring[1000&(fecRingSize-1)]; ds.shardsCount != 1 || ds.dataRecvd != 1 {
+		t.Fatalf("stale group isn't dropped")
+	}
+
+	// restarted encoder
+	binary.LittleEndian.PutUint32(parity, 5000)
+	decoder.Decode(parity, now)
+	binary.LittleEndian.PutUint32(parity, 0)
+	decoder.Decode(parity, now)
+	if decoder.maxGroup != 0 || decoder.ring[5000&(fecRingSize-1)].used {
+		t.Fatalf("restarted encoder isn't followed: %v", decoder.maxGroup)
+	}
+}
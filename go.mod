@@ -1,9 +1,10 @@
 module github.com/shaoyuan1943/gouxp
 
-go 1.13
+go 1.19
 
 require (
 	github.com/fatih/color v1.9.0
+	github.com/klauspost/compress v1.17.4
 	github.com/klauspost/cpuid v1.3.1 // indirect
 	github.com/klauspost/reedsolomon v1.9.9
 	github.com/mmcloughlin/avo v0.0.0-20200803215136-443f81d77104 // indirect
@@ -0,0 +1,378 @@
+package gouxp
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// client handshake data:
+// | convID: 4bytes | crypto public key: 32bytes | crypto type count: 1byte | crypto types: 1byte each |
+// | dictionary count: 1byte | dictionary IDs: 4bytes each | fec data shards: 1byte | fec parity shards: 1byte |
+// | read buffer length: 4bytes | KCP MTU: 2bytes | client identity key type: 1byte | client identity key: 32bytes |
+// | identity signature: 64bytes |
+// client identity is optional, signature covers everything before it
+// server handshake data:
+// | crypto public key: 32bytes | status: 1byte | crypto type: 1byte | dictionary ID: 4bytes |
+// | fec data shards: 1byte | fec parity shards: 1byte | read buffer length: 4bytes | identity signature: 64bytes |
+// | key confirmation: 32bytes |
+// client lists crypto types it supports, server chooses one by its own preference and confirms it.
+// key exchange is done even no crypto is chosen, session keys are derived from handshake transcript
+// and server sends key confirmation derived with them, client rejects handshake when it doesn't match,
+// so crypto types offered by client and chosen by server can't be changed on the way.
+// compression dictionary is chosen the same way, dictionary ID 0 means none.
+// client asks for FEC shards, server confirms shards both sides use from handshake, 0 means no FEC.
+// both sides tell their read buffer length, packets sent to remote MUST be smaller than it.
+// client tells its KCP MTU, server chooses FEC shards which fit both read buffers, see fecHandshakeMTU.
+// handshake itself is always encrypted by Chacha20poly1305 with PSK, chosen codec is used after it
+const (
+	handshakeStatusAccepted       byte = 0x00
+	handshakeStatusCryptoMismatch byte = 0x01
+	handshakeStatusAuthFailed     byte = 0x02
+)
+
+const (
+	maxHandshakeCryptoTypes = 16
+	clientHelloMinSize      = 4 + keyExchangePublicKeySize + 1
+	clientIdentitySize      = 1 + ed25519.PublicKeySize + identitySignatureSize
+	fecConfigSize           = 2
+	bufferLenSize           = 4
+	mtuSize                 = 2
+	// no UDP packet is larger than it
+	maxBufferLen = 64 * 1024
+	// signature covers everything before it
+	serverHelloSignedSize    = keyExchangePublicKeySize + 6 + fecConfigSize + bufferLenSize
+	serverHelloConfirmOffset = serverHelloSignedSize + identitySignatureSize
+	serverHelloSize          = serverHelloConfirmOffset + handshakeConfirmSize
+	handshakeCryptoType      = UseChacha20
+)
+
+type clientHello struct {
+	convID      uint32
+	publicKey   []byte
+	cryptoTypes []CryptoType
+	dictIDs     []uint32
+	fec         fecConfig
+	bufferLen   int
+	mtu         int
+	identity    *ClientIdentity
+	signature   []byte
+}
+
+// signature is left empty, it is filled after encoding
+func (h *clientHello) encode() []byte {
+	data := make([]byte, clientHelloMinSize, clientHelloMinSize+len(h.cryptoTypes)+1+4*len(h.dictIDs)+fecConfigSize+bufferLenSize+mtuSize+clientIdentitySize)
+	binary.LittleEndian.PutUint32(data, h.convID)
+	copy(data[4:], h.publicKey)
+	data[4+keyExchangePublicKeySize] = byte(len(h.cryptoTypes))
+	for _, tp := range h.cryptoTypes {
+		data = append(data, byte(tp))
+	}
+
+	data = appendDictIDs(data, h.dictIDs)
+	data = appendFECConfig(data, h.fec)
+	data = appendBufferLen(data, h.bufferLen)
+	data = appendMTU(data, h.mtu)
+
+	if h.identity != nil {
+		data = append(data, byte(h.identity.KeyType))
+		data = append(data, h.identity.PublicKey...)
+		data = append(data, make([]byte, identitySignatureSize)...)
+	}
+
+	return data
+}
+
+// returns client hello and its encoded bytes for transcript
+func parseClientHello(data []byte) (*clientHello, []byte, error) {
+	if len(data) < clientHelloMinSize {
+		return nil, nil, gokcp.ErrDataInvalid
+	}
+
+	h := &clientHello{}
+	h.convID = binary.LittleEndian.Uint32(data)
+	h.publicKey = data[4 : 4+keyExchangePublicKeySize]
+	count := int(data[4+keyExchangePublicKeySize])
+	if count > maxHandshakeCryptoTypes || len(data) < clientHelloMinSize+count {
+		return nil, nil, gokcp.ErrDataInvalid
+	}
+
+	for _, tp := range data[clientHelloMinSize : clientHelloMinSize+count] {
+		h.cryptoTypes = append(h.cryptoTypes, CryptoType(tp))
+	}
+
+	size := clientHelloMinSize + count
+	dictIDs, n, err := parseDictIDs(data[size:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.dictIDs = dictIDs
+	size += n
+	h.fec, err = parseFECConfig(data[size:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size += fecConfigSize
+	h.bufferLen, err = parseBufferLen(data[size:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size += bufferLenSize
+	h.mtu, err = parseMTU(data[size:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size += mtuSize
+	if len(data) >= size+clientIdentitySize {
+		if ClientKeyType(data[size]) != ClientKeyEd25519 {
+			return nil, nil, gokcp.ErrDataInvalid
+		}
+
+		h.identity = &ClientIdentity{KeyType: ClientKeyEd25519}
+		h.identity.PublicKey = data[size+1 : size+1+ed25519.PublicKeySize]
+		h.signature = data[size+1+ed25519.PublicKeySize : size+clientIdentitySize]
+		size += clientIdentitySize
+	}
+
+	return h, data[:size], nil
+}
+
+type serverHello struct {
+	publicKey  []byte
+	status     byte
+	cryptoType CryptoType
+	dictID     uint32
+	fec        fecConfig
+	bufferLen  int
+	signature  []byte
+	confirm    []byte
+}
+
+func (h *serverHello) encode() []byte {
+	data := make([]byte, serverHelloSize)
+	copy(data, h.publicKey)
+	data[keyExchangePublicKeySize] = h.status
+	data[keyExchangePublicKeySize+1] = byte(h.cryptoType)
+	binary.LittleEndian.PutUint32(data[keyExchangePublicKeySize+2:], h.dictID)
+	data[keyExchangePublicKeySize+6] = byte(h.fec.dataShards)
+	data[keyExchangePublicKeySize+7] = byte(h.fec.parityShards)
+	binary.LittleEndian.PutUint32(data[keyExchangePublicKeySize+6+fecConfigSize:], uint32(h.bufferLen))
+	copy(data[serverHelloSignedSize:], h.signature)
+	copy(data[serverHelloConfirmOffset:], h.confirm)
+	return data
+}
+
+func parseServerHello(data []byte) (*serverHello, error) {
+	if len(data) < serverHelloSize {
+		return nil, gokcp.ErrDataInvalid
+	}
+
+	h := &serverHello{}
+	h.publicKey = data[:keyExchangePublicKeySize]
+	h.status = data[keyExchangePublicKeySize]
+	h.cryptoType = CryptoType(data[keyExchangePublicKeySize+1])
+	h.dictID = binary.LittleEndian.Uint32(data[keyExchangePublicKeySize+2:])
+	fec, err := parseFECConfig(data[keyExchangePublicKeySize+6:])
+	if err != nil {
+		return nil, err
+	}
+
+	h.fec = fec
+	h.bufferLen, err = parseBufferLen(data[keyExchangePublicKeySize+6+fecConfigSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	h.signature = data[serverHelloSignedSize:serverHelloConfirmOffset]
+	h.confirm = data[serverHelloConfirmOffset:serverHelloSize]
+	return h, nil
+}
+
+// | client handshake data | server handshake data before signature |
+func handshakeTranscript(clientHandshakeData, serverHandshakeData []byte) []byte {
+	transcript := make([]byte, 0, len(clientHandshakeData)+serverHelloSignedSize)
+	transcript = append(transcript, clientHandshakeData...)
+	return append(transcript, serverHandshakeData[:serverHelloSignedSize]...)
+}
+
+// server side of key exchange, rsp gets server public key. returns encoded rsp with key confirmation
+func serverKeyExchange(rsp *serverHello, clientPublicKey, clientHandshakeData []byte) ([]byte, *sessionKeys, error) {
+	kx, err := newX25519KeyExchange()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := kx.Secret(clientPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rsp.publicKey = kx.PublicKey()
+	rspData := rsp.encode()
+	keys, err := deriveSessionKeys(secret, handshakeTranscript(clientHandshakeData, rspData))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copy(rspData[serverHelloConfirmOffset:], keys.confirm)
+	return rspData, keys, nil
+}
+
+// | dictionary count: 1byte | dictionary IDs: 4bytes each |
+func appendDictIDs(data []byte, dictIDs []uint32) []byte {
+	data = append(data, byte(len(dictIDs)))
+	for _, id := range dictIDs {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], id)
+		data = append(data, b[:]...)
+	}
+
+	return data
+}
+
+// returns IDs and parsed size
+func parseDictIDs(data []byte) ([]uint32, int, error) {
+	if len(data) < 1 {
+		return nil, 0, gokcp.ErrDataInvalid
+	}
+
+	count := int(data[0])
+	size := 1 + 4*count
+	if count > maxHandshakeDicts || len(data) < size {
+		return nil, 0, gokcp.ErrDataInvalid
+	}
+
+	var dictIDs []uint32
+	for i := 1; i < size; i += 4 {
+		dictIDs = append(dictIDs, binary.LittleEndian.Uint32(data[i:]))
+	}
+
+	return dictIDs, size, nil
+}
+
+// | fec data shards: 1byte | fec parity shards: 1byte |
+func appendFECConfig(data []byte, cfg fecConfig) []byte {
+	return append(data, byte(cfg.dataShards), byte(cfg.parityShards))
+}
+
+func parseFECConfig(data []byte) (fecConfig, error) {
+	if len(data) < fecConfigSize {
+		return fecConfig{}, gokcp.ErrDataInvalid
+	}
+
+	cfg := fecConfig{dataShards: int(data[0]), parityShards: int(data[1])}
+	if cfg.dataShards == 0 && cfg.parityShards != 0 {
+		return fecConfig{}, gokcp.ErrDataInvalid
+	}
+
+	return cfg, nil
+}
+
+// | read buffer length: 4bytes |
+func appendBufferLen(data []byte, bufferLen int) []byte {
+	var b [bufferLenSize]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(bufferLen))
+	return append(data, b[:]...)
+}
+
+func parseBufferLen(data []byte) (int, error) {
+	if len(data) < bufferLenSize {
+		return 0, gokcp.ErrDataInvalid
+	}
+
+	bufferLen := binary.LittleEndian.Uint32(data)
+	if bufferLen == 0 || bufferLen > maxBufferLen {
+		return 0, gokcp.ErrDataInvalid
+	}
+
+	return int(bufferLen), nil
+}
+
+// | KCP MTU: 2bytes |
+func appendMTU(data []byte, mtu int) []byte {
+	var b [mtuSize]byte
+	binary.LittleEndian.PutUint16(b[:], uint16(mtu))
+	return append(data, b[:]...)
+}
+
+func parseMTU(data []byte) (int, error) {
+	if len(data) < mtuSize {
+		return 0, gokcp.ErrDataInvalid
+	}
+
+	mtu := binary.LittleEndian.Uint16(data)
+	if mtu == 0 {
+		return 0, gokcp.ErrDataInvalid
+	}
+
+	return int(mtu), nil
+}
+
+// first of server types which client supports
+func chooseCryptoType(serverTypes, clientTypes []CryptoType) (CryptoType, bool) {
+	for _, tp := range serverTypes {
+		if containsCryptoType(clientTypes, tp) {
+			return tp, true
+		}
+	}
+
+	return UseNoCrypto, false
+}
+
+func containsCryptoType(types []CryptoType, tp CryptoType) bool {
+	for _, v := range types {
+		if v == tp {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkCryptoTypes(types []CryptoType) error {
+	if len(types) == 0 || len(types) > maxHandshakeCryptoTypes {
+		return ErrInvalidCryptoType
+	}
+
+	for _, tp := range types {
+		if tp != UseNoCrypto && createCryptoCodec(tp) == nil {
+			return ErrInvalidCryptoType
+		}
+	}
+
+	return nil
+}
+
+// handshake packet: | header | handshake data |
+func handshakePacket(protoType ProtoType, data []byte) []byte {
+	packet := make([]byte, int(PacketHeaderSize)+len(data))
+	binary.LittleEndian.PutUint16(packet[protoOffset:], uint16(protoType))
+	copy(packet[PacketHeaderSize:], data)
+	return packet
+}
+
+// handshake codecs use PSK
+func newHandshakeCodecs(psk []byte) (encoder, decoder CryptCodec) {
+	encoder = createCryptoCodec(handshakeCryptoType)
+	decoder = createCryptoCodec(handshakeCryptoType)
+	encoder.SetKey(psk)
+	decoder.SetKey(psk)
+	return
+}
+
+// codecs of chosen crypto type with session keys, nil if no crypto
+func newSessionCodecs(tp CryptoType, writeKey, writeNonce, readKey, readNonce []byte) (encoder, decoder CryptCodec) {
+	encoder = createCryptoCodec(tp)
+	decoder = createCryptoCodec(tp)
+	if encoder == nil || decoder == nil {
+		return nil, nil
+	}
+
+	installSessionKeys(encoder, decoder, writeKey, writeNonce, readKey, readNonce)
+	return
+}
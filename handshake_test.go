@@ -0,0 +1,172 @@
+package gouxp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+type handshakeTestHandler struct {
+	ready  chan struct{}
+	closed chan error
+}
+
+func newHandshakeTestHandler() *handshakeTestHandler {
+	return &handshakeTestHandler{ready: make(chan struct{}), closed: make(chan error, 1)}
+}
+
+func (h *handshakeTestHandler) OnClosed(err error) {
+	select {
+	case h.closed <- err:
+	default:
+	}
+}
+
+func (h *handshakeTestHandler) OnNewDataComing(data []byte) {}
+func (h *handshakeTestHandler) OnReady()                    { close(h.ready) }
+
+type handshakeTestServer struct {
+	conns chan *ServerConn
+}
+
+func (h *handshakeTestServer) OnNewConnComing(conn *ServerConn) {
+	conn.SetConnHandler(newHandshakeTestHandler())
+	h.conns <- conn
+}
+
+func (h *handshakeTestServer) OnConnClosed(conn *ServerConn, err error) {}
+func (h *handshakeTestServer) OnClosed(err error)                       {}
+
+// handshake over localhost UDP, returns server conn when client is ready, or error client is closed with
+func runHandshake(t *testing.T, serverSetup func(s *Server), clientSetup func(c *ClientConn)) (*ServerConn, error) {
+	serverRWC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+
+	serverHandler := &handshakeTestServer{conns: make(chan *ServerConn, 1)}
+	server := NewServer(serverRWC, serverHandler, 2, 4096)
+	serverSetup(server)
+	server.Start()
+	defer server.Close()
+
+	clientRWC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+
+	clientHandler := newHandshakeTestHandler()
+	client := NewClientConn(clientRWC, serverRWC.LocalAddr(), clientHandler, 4096)
+	clientSetup(client)
+	if err = client.Start(); err != nil {
+		t.Fatalf("client start err: %v", err)
+	}
+
+	defer client.Close()
+
+	select {
+	case <-clientHandler.ready:
+	case err = <-clientHandler.closed:
+		return nil, err
+	case <-time.After(2 * time.Second):
+		t.Fatalf("handshake timeout")
+	}
+
+	select {
+	case conn := <-serverHandler.conns:
+		return conn, nil
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server conn isn't established")
+	}
+
+	return nil, nil
+}
+
+func TestHandshakeClientKeyring(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	_, otherPrivateKey, _ := ed25519.GenerateKey(nil)
+	serverKey, serverPublicKey, _ := GenerateNoiseKey()
+	clientKey, clientPublicKey, _ := GenerateNoiseKey()
+	otherKey, _, _ := GenerateNoiseKey()
+	keyring := func(identity *ClientIdentity) bool {
+		switch identity.KeyType {
+		case ClientKeyEd25519:
+			return bytes.Equal(identity.PublicKey, publicKey)
+		case ClientKeyX25519:
+			return bytes.Equal(identity.PublicKey, clientPublicKey)
+		}
+
+		return false
+	}
+
+	serverSetup := func(s *Server) {
+		s.UseCryptoCodec(UseChacha20)
+		s.SetNoiseStaticKey(serverKey)
+		s.SetClientKeyring(keyring)
+	}
+
+	// accepted keys are exposed by server conn
+	conn, err := runHandshake(t, serverSetup, func(c *ClientConn) {
+		c.UseCryptoCodec(UseChacha20)
+		c.SetClientKey(privateKey)
+	})
+
+	if err != nil {
+		t.Fatalf("ed25519 handshake err: %v", err)
+	}
+
+	if identity := conn.ClientIdentity(); identity == nil || identity.KeyType != ClientKeyEd25519 || !bytes.Equal(identity.PublicKey, publicKey) {
+		t.Fatalf("client identity: %+v", identity)
+	}
+
+	conn, err = runHandshake(t, serverSetup, func(c *ClientConn) {
+		c.UseCryptoCodec(UseChacha20)
+		c.UseNoiseXX(clientKey, serverPublicKey)
+	})
+
+	if err != nil {
+		t.Fatalf("noise XX handshake err: %v", err)
+	}
+
+	if identity := conn.ClientIdentity(); identity == nil || identity.KeyType != ClientKeyX25519 || !bytes.Equal(identity.PublicKey, clientPublicKey) {
+		t.Fatalf("client identity: %+v", identity)
+	}
+
+	if !bytes.Equal(conn.RemoteStaticKey(), clientPublicKey) {
+		t.Fatalf("remote static key mismatch")
+	}
+
+	// unauthenticated packets can't carry client identity
+	_, err = runHandshake(t, func(s *Server) {
+		serverSetup(s)
+		s.UseCryptoCodecs(UseChacha20, UseNoCrypto)
+	}, func(c *ClientConn) {
+		c.UseCryptoCodec(UseNoCrypto)
+		c.SetClientKey(privateKey)
+	})
+
+	if err != ErrCryptoNegotiationFailed {
+		t.Fatalf("no crypto with client key err: %v", err)
+	}
+
+	// rejected client is told before it is ready
+	forged := append(append(ed25519.PrivateKey(nil), otherPrivateKey.Seed()...), publicKey...)
+	for name, setup := range map[string]func(c *ClientConn){
+		"unknown ed25519 key": func(c *ClientConn) { c.SetClientKey(otherPrivateKey) },
+		"invalid signature":   func(c *ClientConn) { c.SetClientKey(forged) },
+		"no key":              func(c *ClientConn) {},
+		"noise NK":            func(c *ClientConn) { c.UseNoiseNK(serverPublicKey) },
+		"unknown noise key":   func(c *ClientConn) { c.UseNoiseXX(otherKey, serverPublicKey) },
+	} {
+		_, err = runHandshake(t, serverSetup, func(c *ClientConn) {
+			c.UseCryptoCodec(UseChacha20)
+			setup(c)
+		})
+
+		if err != ErrClientAuthFailed {
+			t.Fatalf("%v err: %v", name, err)
+		}
+	}
+}
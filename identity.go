@@ -0,0 +1,104 @@
+package gouxp
+
+import (
+	"crypto/ed25519"
+)
+
+// server signs handshake response with its long-term Ed25519 key, signed message is:
+// | label | client handshake data | server handshake data before signature |
+// client handshake data includes its fresh public key, signature can't be replayed
+const identitySignatureSize = ed25519.SignatureSize
+
+var identitySignatureLabel = []byte("gouxp server identity")
+
+func identityMessage(clientHandshakeData, serverHandshakeData []byte) []byte {
+	message := make([]byte, 0, len(identitySignatureLabel)+len(clientHandshakeData)+len(serverHandshakeData))
+	message = append(message, identitySignatureLabel...)
+	message = append(message, clientHandshakeData...)
+	return append(message, serverHandshakeData...)
+}
+
+func signIdentity(key ed25519.PrivateKey, clientHandshakeData, serverHandshakeData []byte) []byte {
+	return ed25519.Sign(key, identityMessage(clientHandshakeData, serverHandshakeData))
+}
+
+// signature MUST match one of trusted keys
+func verifyIdentity(trustedKeys []ed25519.PublicKey, clientHandshakeData, serverHandshakeData, signature []byte) error {
+	if len(signature) < identitySignatureSize {
+		return ErrServerAuthFailed
+	}
+
+	message := identityMessage(clientHandshakeData, serverHandshakeData)
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, message, signature[:identitySignatureSize]) {
+			return nil
+		}
+	}
+
+	return ErrServerAuthFailed
+}
+
+// client proves its Ed25519 key by signing client handshake data, signed message is:
+// | label | client handshake data before signature |
+// handshake data includes fresh public key and session keys need its private key,
+// replayed handshake is useless
+var clientIdentitySignatureLabel = []byte("gouxp client identity")
+
+type ClientKeyType byte
+
+const (
+	// signature in default handshake
+	ClientKeyEd25519 ClientKeyType = 0x01
+	// static key of Noise XX handshake
+	ClientKeyX25519 ClientKeyType = 0x02
+)
+
+// client key proved in handshake
+type ClientIdentity struct {
+	KeyType   ClientKeyType
+	PublicKey []byte
+}
+
+// server checks client key, false rejects handshake
+type ClientKeyring func(identity *ClientIdentity) bool
+
+func clientIdentityMessage(clientHandshakeData []byte) []byte {
+	message := make([]byte, 0, len(clientIdentitySignatureLabel)+len(clientHandshakeData))
+	message = append(message, clientIdentitySignatureLabel...)
+	return append(message, clientHandshakeData...)
+}
+
+func signClientIdentity(key ed25519.PrivateKey, clientHandshakeData []byte) []byte {
+	return ed25519.Sign(key, clientIdentityMessage(clientHandshakeData))
+}
+
+func verifyClientIdentity(key ed25519.PublicKey, clientHandshakeData, signature []byte) bool {
+	return ed25519.Verify(key, clientIdentityMessage(clientHandshakeData), signature)
+}
+
+// client without key is rejected when server has keyring
+func checkClientIdentity(keyring ClientKeyring, identity *ClientIdentity) bool {
+	if keyring == nil {
+		return true
+	}
+
+	return identity != nil && keyring(identity)
+}
+
+// client key means nothing if session packets aren't authenticated, replayed handshake would get
+// a conn with identity of its client. server with keyring only chooses authenticated crypto types
+func clientAuthCryptoTypes(keyring ClientKeyring, types []CryptoType) []CryptoType {
+	if keyring == nil {
+		return types
+	}
+
+	var authTypes []CryptoType
+	for _, tp := range types {
+		switch tp {
+		case UseChacha20, UseSalsa20, UseAES128GCM, UseAES256GCM, UseXChacha20, UsePoly1305Auth:
+			authTypes = append(authTypes, tp)
+		}
+	}
+
+	return authTypes
+}
@@ -0,0 +1,26 @@
+package gouxp
+
+// KCPProfile is a set of KCP parameters
+// NoDelay: enable nodelay mode, min RTO is 30ms in nodelay mode otherwise 100ms
+// Interval: KCP update interval in ms
+// Resend: fast resend after ACK skipped times, 0 is disable fast resend
+// NoCongestion: disable KCP built-in congestion window
+// DeadLink: conn is closed when a segment is sent so many times, 0 is disable it
+// min RTO can't be set alone, gokcp has no setter for it and only changes it with NoDelay
+type KCPProfile struct {
+	NoDelay      bool
+	Interval     int
+	Resend       int
+	NoCongestion bool
+	DeadLink     int
+}
+
+var (
+	KCPProfileNormal = KCPProfile{NoDelay: false, Interval: 40, Resend: 0, NoCongestion: false}
+	KCPProfileFast   = KCPProfile{NoDelay: false, Interval: 30, Resend: 2, NoCongestion: true}
+	KCPProfileFast2  = KCPProfile{NoDelay: true, Interval: 20, Resend: 2, NoCongestion: true}
+	KCPProfileTurbo  = KCPProfile{NoDelay: true, Interval: 10, Resend: 2, NoCongestion: true}
+)
+
+// gouxp default
+var defaultKCPProfile = KCPProfile{NoDelay: true, Interval: 10, Resend: 2, NoCongestion: true}
@@ -0,0 +1,89 @@
+package gouxp
+
+import (
+	"testing"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+func TestKCPProfile(t *testing.T) {
+	conn, _ := newCaptureConn(4096)
+	if _, ok := conn.congestion.(*NoCongestion); !ok || conn.KCPProfile() != defaultKCPProfile {
+		t.Fatalf("default profile invalid")
+	}
+
+	conn.ApplyKCPProfile(KCPProfileNormal)
+	if _, ok := conn.congestion.(*KCPCongestion); !ok || conn.KCPProfile() != KCPProfileNormal {
+		t.Fatalf("profile congestion isn't applied")
+	}
+
+	// controller set by user is kept by profile
+	cc := NewDelayCongestion(0, 0)
+	conn.SetCongestionControl(cc)
+	conn.ApplyKCPProfile(KCPProfileTurbo)
+	conn.SetNoDelay(false, 20, 0, false)
+	if conn.congestion != cc {
+		t.Fatalf("congestion controller is reset by profile")
+	}
+
+	profile := conn.KCPProfile()
+	if profile.NoDelay || profile.Interval != 20 || profile.Resend != 0 || profile.NoCongestion {
+		t.Fatalf("nodelay isn't applied: %+v", profile)
+	}
+
+	// nil gives control back to profile
+	conn.SetCongestionControl(nil)
+	if _, ok := conn.congestion.(*KCPCongestion); !ok {
+		t.Fatalf("profile congestion isn't restored")
+	}
+
+	conn.SetNoDelay(true, 10, 2, true)
+	if _, ok := conn.congestion.(*NoCongestion); !ok {
+		t.Fatalf("profile congestion isn't applied")
+	}
+}
+
+func TestDeadLink(t *testing.T) {
+	packet := make([]byte, PacketHeaderSize)
+	packet = appendKCPSegment(packet, gokcp.KCP_CMD_PUSH, 0, 0, 100)
+
+	// disabled by default
+	conn, _ := newCaptureConn(4096)
+	for i := 0; i < 100; i++ {
+		if err := conn.onKCPDataOutput(append([]byte(nil), packet...)); err != nil {
+			t.Fatalf("output err: %v", err)
+		}
+	}
+
+	if err := conn.checkDeadLink(); err != nil {
+		t.Fatalf("dead link is enabled by default: %v", err)
+	}
+
+	conn, _ = newCaptureConn(4096)
+	conn.SetDeadLink(3)
+	for i := 0; i < 2; i++ {
+		conn.onKCPDataOutput(append([]byte(nil), packet...))
+	}
+
+	if err := conn.checkDeadLink(); err != nil {
+		t.Fatalf("dead link before limit: %v", err)
+	}
+
+	// acknowledged segments don't count
+	conn.sampler.onInput(conn.congestion, appendKCPSegment(nil, gokcp.KCP_CMD_ACK, 0, 1, 0), gokcp.SetupFromNowMS())
+	next := appendKCPSegment(make([]byte, PacketHeaderSize), gokcp.KCP_CMD_PUSH, 1, 1, 100)
+	for i := 0; i < 2; i++ {
+		conn.onKCPDataOutput(append([]byte(nil), next...))
+	}
+
+	if err := conn.checkDeadLink(); err != nil {
+		t.Fatalf("acknowledged segment counts for dead link: %v", err)
+	}
+
+	// dead link state is kept when congestion controller changes
+	conn.onKCPDataOutput(append([]byte(nil), next...))
+	conn.SetCongestionControl(NewKCPCongestion())
+	if err := conn.checkDeadLink(); err != ErrDeadLink {
+		t.Fatalf("dead link err: %v", err)
+	}
+}
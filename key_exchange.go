@@ -0,0 +1,125 @@
+package gouxp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// public key field in handshake is X25519 public key
+const (
+	keyExchangePublicKeySize = 32
+	keyExchangeSecretSize    = 32
+	sessionKeySize           = 32
+	sessionNonceSize         = 24
+	handshakeConfirmSize     = 32
+)
+
+var (
+	sessionClientLabel  = []byte("gouxp client to server")
+	sessionServerLabel  = []byte("gouxp server to client")
+	sessionConfirmLabel = []byte("gouxp handshake confirm")
+)
+
+// keys and nonces for each direction, client writes with client key and server writes with server key.
+// confirm is sent by server, client checks both sides see the same handshake
+type sessionKeys struct {
+	clientKey   []byte
+	clientNonce []byte
+	serverKey   []byte
+	serverNonce []byte
+	confirm     []byte
+}
+
+// HKDF-SHA256 over shared secret, salt is hash of handshake transcript:
+// | client handshake data | server handshake data |
+func deriveSessionKeys(secret, transcript []byte) (*sessionKeys, error) {
+	salt := sha256.Sum256(transcript)
+	keys := &sessionKeys{}
+	var err error
+	keys.clientKey, keys.clientNonce, err = expandSessionKey(secret, salt[:], sessionClientLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.serverKey, keys.serverNonce, err = expandSessionKey(secret, salt[:], sessionServerLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.confirm = make([]byte, handshakeConfirmSize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, salt[:], sessionConfirmLabel), keys.confirm); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func expandSessionKey(secret, salt, label []byte) (key, nonce []byte, err error) {
+	material := make([]byte, sessionKeySize+sessionNonceSize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, salt, label), material); err != nil {
+		return nil, nil, err
+	}
+
+	return material[:sessionKeySize], material[sessionKeySize:], nil
+}
+
+// encoder writes with local key, decoder reads with remote key
+func installSessionKeys(encoder, decoder CryptCodec, writeKey, writeNonce, readKey, readNonce []byte) {
+	encoder.SetKey(writeKey)
+	encoder.SetWriteNonce(writeNonce)
+	decoder.SetKey(readKey)
+	decoder.SetReadNonce(readNonce)
+}
+
+type x25519KeyExchange struct {
+	privateKey [32]byte
+	publicKey  []byte
+}
+
+func newX25519KeyExchange() (*x25519KeyExchange, error) {
+	var privateKey [32]byte
+	if _, err := rand.Read(privateKey[:]); err != nil {
+		return nil, err
+	}
+
+	return newX25519KeyExchangeFromKey(privateKey[:])
+}
+
+// static key pair
+func newX25519KeyExchangeFromKey(privateKey []byte) (*x25519KeyExchange, error) {
+	if len(privateKey) != keyExchangeSecretSize {
+		return nil, ErrInvalidPublicKey
+	}
+
+	kx := &x25519KeyExchange{}
+	copy(kx.privateKey[:], privateKey)
+	publicKey, err := curve25519.X25519(kx.privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	kx.publicKey = publicKey
+	return kx, nil
+}
+
+func (kx *x25519KeyExchange) PublicKey() []byte {
+	return kx.publicKey
+}
+
+// low order public key is rejected by X25519
+func (kx *x25519KeyExchange) Secret(remotePublicKey []byte) ([]byte, error) {
+	if len(remotePublicKey) < keyExchangePublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+
+	secret, err := curve25519.X25519(kx.privateKey[:], remotePublicKey[:keyExchangePublicKeySize])
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	return secret, nil
+}
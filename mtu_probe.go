@@ -0,0 +1,284 @@
+package gouxp
+
+import (
+	"encoding/binary"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// mtu probe packet format:
+// | header: 26bytes | probe size: 2bytes | padding |
+// probe ack packet format:
+// | header: 26bytes | probe size: 2bytes |
+// probe size is KCP MTU which prober want to use, FEC header is included in padding if FEC enabled.
+// probe never exceeds read buffer of remote, FEC header is always reserved for it
+
+const (
+	mtuProbeMinMTU   = 576
+	mtuProbeTimeout  = 1000
+	mtuProbeRetries  = 2
+	mtuProbeAccuracy = 8
+	// probe again every 10min, path may change
+	mtuProbeInterval   = 10 * 60 * 1000
+	mtuProbeBufferSize = PacketHeaderSize + 2
+)
+
+type mtuProber struct {
+	enabled   bool
+	searching bool
+	minMTU    int
+	maxMTU    int
+	low       int
+	high      int
+	probing   int
+	sentTime  uint32
+	retries   int
+	nextTime  uint32
+	// shrink MTU when KCP has no data in flight, data written meanwhile is held
+	// and sent to KCP after it, so it's split by new MTU
+	pendingMTU   int
+	held         [][]byte
+	heldSegments int
+}
+
+func (p *mtuProber) restart(now uint32) {
+	p.searching = true
+	p.low = p.minMTU
+	p.high = p.maxMTU
+	p.probing = 0
+	p.retries = 0
+	p.nextTime = now
+}
+
+func (conn *RawConn) stopMTUDiscovery() {
+	p := &conn.mtuProber
+	p.enabled = false
+	p.searching = false
+	p.probing = 0
+}
+
+// next candidate, 0 means search finished
+func (p *mtuProber) candidate() int {
+	if p.high-p.low < mtuProbeAccuracy {
+		return 0
+	}
+
+	return (p.low + p.high + 1) / 2
+}
+
+func (conn *RawConn) fecOverhead() int {
+	if conn.fecEncoder != nil && conn.fecDecoder != nil {
+		return fecHeaderSize
+	}
+
+	return 0
+}
+
+func (conn *RawConn) sendMTUProbe(mtu int, now uint32) error {
+	probeBuffer := make([]byte, mtu+conn.fecOverhead())
+	binary.LittleEndian.PutUint16(probeBuffer[protoOffset:], uint16(protoTypeMTUProbe))
+	binary.LittleEndian.PutUint16(probeBuffer[PacketHeaderSize:], uint16(mtu))
+
+	conn.mtuProber.probing = mtu
+	conn.mtuProber.sentTime = now
+
+	cipherData, err := conn.encrypt(probeBuffer)
+	if err != nil {
+		return err
+	}
+
+	return conn.write(cipherData)
+}
+
+// invoke in update loop, conn is locked
+func (conn *RawConn) updateMTUProbe(now uint32) error {
+	p := &conn.mtuProber
+	if p.pendingMTU > 0 && conn.kcp.WaitSend() == 0 {
+		conn.resizeMTU(p.pendingMTU)
+		p.pendingMTU = 0
+	}
+
+	if p.pendingMTU == 0 && len(p.held) > 0 {
+		err := conn.sendHeld()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !p.enabled {
+		return nil
+	}
+
+	if !p.searching {
+		if int32(now-p.nextTime) < 0 {
+			return nil
+		}
+
+		p.restart(now)
+	}
+
+	if p.probing > 0 {
+		if now-p.sentTime < mtuProbeTimeout {
+			return nil
+		}
+
+		p.retries++
+		if p.retries <= mtuProbeRetries {
+			return conn.sendMTUProbe(p.probing, now)
+		}
+
+		// probe size is not working
+		p.high = p.probing - 1
+		p.probing = 0
+		p.retries = 0
+	}
+
+	if limit := conn.remoteMaxMTU(); limit > 0 && p.high > limit {
+		p.high = limit
+		if p.low > p.high {
+			p.low = p.high
+		}
+	}
+
+	mtu := p.candidate()
+	if mtu > 0 {
+		return conn.sendMTUProbe(mtu, now)
+	}
+
+	// search finished
+	p.searching = false
+	p.nextTime = now + mtuProbeInterval
+	conn.applyMTU(p.low)
+	return nil
+}
+
+// largest KCP MTU remote can read with FEC header, 0 if remote is unknown
+func (conn *RawConn) remoteMaxMTU() int {
+	if conn.remoteBufferLen <= 0 {
+		return 0
+	}
+
+	return conn.remoteBufferLen - 1 - fecHeaderSize
+}
+
+// grow MTU immediately, shrink MTU after in flight data is done because segments in KCP
+// can't be split again
+func (conn *RawConn) applyMTU(mtu int) {
+	conn.mtuProber.pendingMTU = 0
+	if mtu == int(conn.kcp.MTU()) {
+		return
+	}
+
+	if mtu < int(conn.kcp.MTU()) && conn.kcp.WaitSend() > 0 {
+		conn.mtuProber.pendingMTU = mtu
+		return
+	}
+
+	conn.resizeMTU(mtu)
+}
+
+func (conn *RawConn) holding() bool {
+	return conn.mtuProber.pendingMTU > 0 || len(conn.mtuProber.held) > 0
+}
+
+// hold data written while MTU is shrinking, it counts as waiting segments of new MTU
+func (conn *RawConn) holdWrite(data []byte) bool {
+	p := &conn.mtuProber
+	mss := int(conn.kcp.MSS())
+	if p.pendingMTU > 0 {
+		mss = p.pendingMTU - int(gokcp.KCP_OVERHEAD) - int(PacketHeaderSize)
+	}
+
+	segments := (len(data) + mss - 1) / mss
+	waitSend := conn.kcp.WaitSend() + p.heldSegments
+	if waitSend >= int(conn.kcp.SendWnd()) || waitSend >= int(conn.kcp.RemoteWnd()) {
+		return false
+	}
+
+	p.held = append(p.held, append([]byte(nil), data...))
+	p.heldSegments += segments
+	return true
+}
+
+func (conn *RawConn) sendHeld() error {
+	p := &conn.mtuProber
+	held := p.held
+	p.held = nil
+	p.heldSegments = 0
+	for _, data := range held {
+		err := conn.kcp.Send(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (conn *RawConn) resizeMTU(mtu int) bool {
+	if mtu >= conn.bufferLen {
+		return false
+	}
+
+	if !conn.kcp.SetMTU(mtu) {
+		return false
+	}
+
+	if !conn.kcp.SetBufferReserved(int(PacketHeaderSize)) {
+		return false
+	}
+
+	if conn.fecEncoder != nil && conn.fecDecoder != nil {
+		conn.fecEncoder.setBufferSize(mtu + fecHeaderSize)
+		conn.fecDecoder.setBufferSize(mtu + fecHeaderSize)
+	}
+
+	return true
+}
+
+// remote probes MTU, tell it probe is arrived
+func (conn *RawConn) onMTUProbe(data []byte) error {
+	if len(data) < 2 {
+		return ErrInvalidMTUProbe
+	}
+
+	mtu := int(binary.LittleEndian.Uint16(data))
+	var ackBuffer [mtuProbeBufferSize]byte
+	binary.LittleEndian.PutUint16(ackBuffer[protoOffset:], uint16(protoTypeMTUProbeACK))
+	binary.LittleEndian.PutUint16(ackBuffer[PacketHeaderSize:], uint16(mtu))
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	// remote may send packets as large as probe
+	if conn.fecDecoder != nil {
+		conn.fecDecoder.setBufferSize(mtu + fecHeaderSize)
+	}
+
+	cipherData, err := conn.encrypt(ackBuffer[:])
+	if err != nil {
+		return err
+	}
+
+	return conn.write(cipherData)
+}
+
+func (conn *RawConn) onMTUProbeACK(data []byte) error {
+	if len(data) < 2 {
+		return ErrInvalidMTUProbe
+	}
+
+	mtu := int(binary.LittleEndian.Uint16(data))
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	p := &conn.mtuProber
+	if p.probing > 0 && mtu == p.probing {
+		p.low = mtu
+		p.probing = 0
+		p.retries = 0
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package gouxp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// capturePacketConn keeps written packets instead of sending them
+type capturePacketConn struct {
+	packets [][]byte
+}
+
+func (c *capturePacketConn) ReadFrom(p []byte) (int, net.Addr, error) { return 0, nil, io.EOF }
+func (c *capturePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.packets = append(c.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+func (c *capturePacketConn) Close() error                       { return nil }
+func (c *capturePacketConn) LocalAddr() net.Addr                { return nil }
+func (c *capturePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *capturePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *capturePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *capturePacketConn) take() [][]byte {
+	packets := c.packets
+	c.packets = nil
+	return packets
+}
+
+func newCaptureConn(bufferLen int) (*RawConn, *capturePacketConn) {
+	rwc := &capturePacketConn{}
+	conn := &RawConn{bufferLen: bufferLen, rwc: rwc}
+	conn.closed.Store(false)
+	conn.initKCP(1, defaultKCPProfile)
+	return conn, rwc
+}
+
+// prober searches path MTU, packets larger than pathMTU are lost
+func runMTUProbe(t *testing.T, prober, remote *RawConn, proberRWC, remoteRWC *capturePacketConn, pathMTU int) {
+	now := uint32(1000)
+	for i := 0; i < 200 && (prober.mtuProber.searching || i == 0); i++ {
+		if err := prober.updateMTUProbe(now); err != nil {
+			t.Fatalf("update mtu probe err: %v", err)
+		}
+
+		for _, packet := range proberRWC.take() {
+			if len(packet) >= remote.bufferLen {
+				t.Fatalf("probe %v exceeds remote read buffer %v", len(packet), remote.bufferLen)
+			}
+
+			if len(packet) > pathMTU {
+				continue
+			}
+
+			if err := remote.onMTUProbe(packet[PacketHeaderSize:]); err != nil {
+				t.Fatalf("on mtu probe err: %v", err)
+			}
+
+			for _, ack := range remoteRWC.take() {
+				if err := prober.onMTUProbeACK(ack[PacketHeaderSize:]); err != nil {
+					t.Fatalf("on mtu probe ack err: %v", err)
+				}
+			}
+		}
+
+		now += mtuProbeTimeout
+	}
+
+	if prober.mtuProber.searching {
+		t.Fatalf("mtu search isn't finished")
+	}
+}
+
+func TestMTUProbe(t *testing.T) {
+	prober, proberRWC := newCaptureConn(4096)
+	remote, remoteRWC := newCaptureConn(4096)
+	prober.remoteBufferLen = remote.bufferLen
+	if prober.EnableMTUDiscovery(576, 4096) || !prober.EnableMTUDiscovery(576, 3000) {
+		t.Fatalf("enable mtu discovery invalid")
+	}
+
+	// MTU is the largest working size in accuracy
+	runMTUProbe(t, prober, remote, proberRWC, remoteRWC, 1200)
+	mtu := int(prober.kcp.MTU())
+	if mtu > 1200 || mtu <= 1200-mtuProbeAccuracy {
+		t.Fatalf("mtu: %v, want about 1200", mtu)
+	}
+
+	if prober.kcp.MSS() != uint32(mtu)-gokcp.KCP_OVERHEAD-uint32(PacketHeaderSize) {
+		t.Fatalf("mss isn't resized: %v", prober.kcp.MSS())
+	}
+
+	// probe ACK of other size is ignored
+	prober.mtuProber.probing = 1000
+	var ack [mtuProbeBufferSize]byte
+	if err := prober.onMTUProbeACK(ack[PacketHeaderSize:][:2]); err != nil || prober.mtuProber.probing != 1000 {
+		t.Fatalf("probe ACK of other size is accepted")
+	}
+
+	if err := prober.onMTUProbeACK(nil); err != ErrInvalidMTUProbe {
+		t.Fatalf("invalid probe ACK err: %v", err)
+	}
+
+	prober.mtuProber.probing = 0
+
+	// probes are clamped to read buffer of remote even path allows more
+	remote, remoteRWC = newCaptureConn(1000)
+	prober.remoteBufferLen = remote.bufferLen
+	prober.mtuProber.restart(0)
+	runMTUProbe(t, prober, remote, proberRWC, remoteRWC, 3000)
+	if mtu := int(prober.kcp.MTU()); mtu <= prober.remoteMaxMTU()-mtuProbeAccuracy || mtu+fecHeaderSize >= remote.bufferLen {
+		t.Fatalf("mtu: %v, remote buffer: %v", mtu, remote.bufferLen)
+	}
+
+	// remote buffer is smaller than min MTU
+	remote, remoteRWC = newCaptureConn(500)
+	prober.remoteBufferLen = remote.bufferLen
+	prober.mtuProber.restart(0)
+	runMTUProbe(t, prober, remote, proberRWC, remoteRWC, 3000)
+	if mtu := int(prober.kcp.MTU()); mtu+fecHeaderSize >= remote.bufferLen {
+		t.Fatalf("mtu: %v, remote buffer: %v", mtu, remote.bufferLen)
+	}
+}
+
+// flush KCP and return sizes of PUSH segments sent
+func flushKCPSegments(t *testing.T, conn *RawConn, rwc *capturePacketConn) ([][]byte, []int) {
+	time.Sleep(time.Duration(conn.profile.Interval+1) * time.Millisecond)
+	if err := conn.kcp.Update(); err != nil {
+		t.Fatalf("kcp update err: %v", err)
+	}
+
+	packets := rwc.take()
+	var sizes []int
+	for _, packet := range packets {
+		eachKCPSegment(packet[PacketHeaderSize:], func(h kcpSegmentHeader) {
+			if h.cmd == gokcp.KCP_CMD_PUSH {
+				sizes = append(sizes, int(h.len))
+			}
+		})
+	}
+
+	return packets, sizes
+}
+
+func TestMTUShrink(t *testing.T) {
+	conn, rwc := newCaptureConn(4096)
+	remote, remoteRWC := newCaptureConn(4096)
+	oldMSS := int(conn.kcp.MSS())
+	data := bytes.Repeat([]byte{1}, 2*oldMSS)
+	if n, err := conn.Write(data); err != nil || n != len(data) {
+		t.Fatalf("write err: %v", err)
+	}
+
+	packets, sizes := flushKCPSegments(t, conn, rwc)
+	if len(sizes) != 2 || sizes[0] != oldMSS || sizes[1] != oldMSS {
+		t.Fatalf("segments: %v", sizes)
+	}
+
+	// segments in KCP can't be split again, shrink waits for them
+	conn.applyMTU(800)
+	newMSS := 800 - int(gokcp.KCP_OVERHEAD) - int(PacketHeaderSize)
+	if conn.kcp.MTU() != 1400 || conn.mtuProber.pendingMTU != 800 {
+		t.Fatalf("mtu is shrunk with data in flight")
+	}
+
+	// write isn't blocked, data is held until MTU is shrunk
+	if n, err := conn.Write(data); err != nil || n != len(data) {
+		t.Fatalf("write while shrinking err: %v", err)
+	}
+
+	if err := conn.updateMTUProbe(gokcp.SetupFromNowMS()); err != nil || conn.kcp.MTU() != 1400 {
+		t.Fatalf("mtu is shrunk before ACK, err: %v", err)
+	}
+
+	if _, sizes = flushKCPSegments(t, conn, rwc); len(sizes) != 0 {
+		t.Fatalf("held data is sent with old MTU: %v", sizes)
+	}
+
+	// remote acknowledges old segments
+	for _, packet := range packets {
+		if err := remote.kcp.Input(packet[PacketHeaderSize:]); err != nil {
+			t.Fatalf("remote input err: %v", err)
+		}
+	}
+
+	acks, _ := flushKCPSegments(t, remote, remoteRWC)
+	for _, ack := range acks {
+		if err := conn.kcp.Input(ack[PacketHeaderSize:]); err != nil {
+			t.Fatalf("input ack err: %v", err)
+		}
+	}
+
+	if err := conn.updateMTUProbe(gokcp.SetupFromNowMS()); err != nil {
+		t.Fatalf("update mtu probe err: %v", err)
+	}
+
+	if int(conn.kcp.MTU()) != 800 || int(conn.kcp.MSS()) != newMSS || conn.holding() {
+		t.Fatalf("mtu isn't shrunk: %v", conn.kcp.MTU())
+	}
+
+	// held data is split by new MTU
+	_, sizes = flushKCPSegments(t, conn, rwc)
+	var want []int
+	for n := len(data); n > 0; n -= newMSS {
+		if n > newMSS {
+			want = append(want, newMSS)
+		} else {
+			want = append(want, n)
+		}
+	}
+
+	if len(sizes) != len(want) {
+		t.Fatalf("segments: %v, want %v", sizes, want)
+	}
+
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("segments: %v, want %v", sizes, want)
+		}
+	}
+
+	// held data is limited by send window
+	conn.applyMTU(600)
+	written := 0
+	for i := 0; i < 10000; i++ {
+		if _, err := conn.Write(data); err == ErrTryAgain {
+			break
+		}
+
+		written++
+	}
+
+	if conn.mtuProber.pendingMTU != 600 || written == 0 || conn.mtuProber.heldSegments > int(conn.kcp.SendWnd())+len(data)/(600-int(gokcp.KCP_OVERHEAD)-int(PacketHeaderSize))+1 {
+		t.Fatalf("held segments: %v, send window: %v", conn.mtuProber.heldSegments, conn.kcp.SendWnd())
+	}
+
+	// growing MTU cancels shrink, held data is sent with new MTU
+	conn.applyMTU(1400)
+	if conn.kcp.MTU() != 1400 || conn.mtuProber.pendingMTU != 0 {
+		t.Fatalf("mtu isn't grown: %v", conn.kcp.MTU())
+	}
+
+	if err := conn.updateMTUProbe(gokcp.SetupFromNowMS()); err != nil || conn.holding() {
+		t.Fatalf("held data isn't sent, err: %v", err)
+	}
+}
@@ -0,0 +1,540 @@
+package gouxp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Noise Framework handshake, Noise_NK_25519_ChaChaPoly_SHA256 and Noise_XX_25519_ChaChaPoly_SHA256.
+// NK: server static key is known by client
+//
+//	<- s
+//	...
+//	-> e, es
+//	<- e, ee
+//
+// XX: both sides send static keys encrypted, mutual authentication
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// noise handshake data:
+// | pattern: 1byte | message index: 1byte | noise message |
+// payload of first client message: | convID: 4bytes | crypto type count: 1byte | crypto types: 1byte each |
+// | dictionary count: 1byte | dictionary IDs: 4bytes each | fec data shards: 1byte | fec parity shards: 1byte |
+// | read buffer length: 4bytes |
+// payload of server message: | status: 1byte | crypto type: 1byte | dictionary ID: 4bytes |
+// | fec data shards: 1byte | fec parity shards: 1byte | read buffer length: 4bytes |
+// XX server checks client static key after last message and tells client the result, client
+// establishes only when it is accepted:
+// | status: 1byte | HMAC-SHA256 of status: 32bytes |, key is derived from handshake
+// noise messages are still in PSK encrypted handshake packet, session keys are derived from
+// Noise split keys and handshake hash
+type noisePattern byte
+
+const (
+	noiseNK noisePattern = 0x01
+	noiseXX noisePattern = 0x02
+)
+
+const (
+	noiseHeaderSize     = 2
+	noiseKeySize        = 32
+	noiseHashSize       = sha256.Size
+	noiseServerPayload  = 6 + fecConfigSize + bufferLenSize
+	noiseClientPayload  = 5
+	noiseMaxMessageSize = 512
+	noiseStatusIndex    = 3
+	noiseStatusSize     = 1 + noiseHashSize
+)
+
+// XX server keeps handshake state between its message and last client message
+const (
+	noisePendingTimeout = 5 * 1000
+	maxPendingNoise     = 1024
+)
+
+type pendingNoise struct {
+	hs         *noiseHandshake
+	convID     uint32
+	cryptoType CryptoType
+	dictID     uint32
+	fec        fecConfig
+	bufferLen  int
+	createTime uint32
+	// PN of status message MUST follow server message, client drops older PN as replayed
+	encoder CryptCodec
+}
+
+var noisePrologue = []byte("gouxp noise handshake")
+
+type noiseToken byte
+
+const (
+	noiseTokenE noiseToken = iota
+	noiseTokenS
+	noiseTokenEE
+	noiseTokenES
+	noiseTokenSE
+)
+
+var noisePatterns = map[noisePattern]struct {
+	name     string
+	messages [][]noiseToken
+}{
+	noiseNK: {
+		name:     "Noise_NK_25519_ChaChaPoly_SHA256",
+		messages: [][]noiseToken{{noiseTokenE, noiseTokenES}, {noiseTokenE, noiseTokenEE}},
+	},
+	noiseXX: {
+		name:     "Noise_XX_25519_ChaChaPoly_SHA256",
+		messages: [][]noiseToken{{noiseTokenE}, {noiseTokenE, noiseTokenEE, noiseTokenS, noiseTokenES}, {noiseTokenS, noiseTokenSE}},
+	},
+}
+
+// X25519 key pair for Noise static key
+func GenerateNoiseKey() (privateKey, publicKey []byte, err error) {
+	kx, err := newX25519KeyExchange()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kx.privateKey[:], kx.PublicKey(), nil
+}
+
+func containsNoiseKey(keys [][]byte, key []byte) bool {
+	for _, v := range keys {
+		if bytes.Equal(v, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkNoiseKey(key []byte) error {
+	if len(key) != noiseKeySize {
+		return ErrInvalidNoiseKey
+	}
+
+	return nil
+}
+
+// symmetric state and handshake state of Noise
+type noiseHandshake struct {
+	pattern   noisePattern
+	initiator bool
+	messages  [][]noiseToken
+	index     int
+	ck        []byte
+	h         []byte
+	aead      cipher.AEAD
+	n         uint64
+	s         *x25519KeyExchange
+	e         *x25519KeyExchange
+	rs        []byte
+	re        []byte
+}
+
+// staticKey is local private key, remoteStaticKey is known in advance for NK initiator
+func newNoiseHandshake(pattern noisePattern, initiator bool, staticKey, remoteStaticKey []byte) (*noiseHandshake, error) {
+	p, ok := noisePatterns[pattern]
+	if !ok {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	hs := &noiseHandshake{pattern: pattern, initiator: initiator, messages: p.messages}
+	if staticKey != nil {
+		s, err := newX25519KeyExchangeFromKey(staticKey)
+		if err != nil {
+			return nil, ErrInvalidNoiseKey
+		}
+
+		hs.s = s
+	}
+
+	if len(p.name) <= noiseHashSize {
+		hs.h = make([]byte, noiseHashSize)
+		copy(hs.h, p.name)
+	} else {
+		sum := sha256.Sum256([]byte(p.name))
+		hs.h = sum[:]
+	}
+
+	hs.ck = append([]byte(nil), hs.h...)
+	hs.mixHash(noisePrologue)
+
+	// pre-message of NK: <- s
+	if pattern == noiseNK {
+		if initiator {
+			if checkNoiseKey(remoteStaticKey) != nil {
+				return nil, ErrInvalidNoiseKey
+			}
+
+			hs.rs = append([]byte(nil), remoteStaticKey...)
+			hs.mixHash(hs.rs)
+		} else {
+			if hs.s == nil {
+				return nil, ErrInvalidNoiseKey
+			}
+
+			hs.mixHash(hs.s.PublicKey())
+		}
+	} else if hs.s == nil {
+		return nil, ErrInvalidNoiseKey
+	}
+
+	return hs, nil
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(hs.h)
+	hash.Write(data)
+	hs.h = hash.Sum(nil)
+}
+
+// HKDF with chaining key as salt
+func (hs *noiseHandshake) hkdf(ikm []byte) (out1, out2 []byte, err error) {
+	out := make([]byte, 2*noiseHashSize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, ikm, hs.ck, nil), out); err != nil {
+		return nil, nil, err
+	}
+
+	return out[:noiseHashSize], out[noiseHashSize:], nil
+}
+
+func (hs *noiseHandshake) mixKey(ikm []byte) error {
+	ck, key, err := hs.hkdf(ikm)
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+
+	hs.ck = ck
+	hs.aead = aead
+	hs.n = 0
+	return nil
+}
+
+// 32bits zeros and 64bits little endian counter
+func (hs *noiseHandshake) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], hs.n)
+	return nonce
+}
+
+func (hs *noiseHandshake) encryptAndHash(dst, plaintext []byte) []byte {
+	if hs.aead == nil {
+		dst = append(dst, plaintext...)
+		hs.mixHash(plaintext)
+		return dst
+	}
+
+	offset := len(dst)
+	dst = hs.aead.Seal(dst, hs.nonce(), plaintext, hs.h)
+	hs.n++
+	hs.mixHash(dst[offset:])
+	return dst
+}
+
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if hs.aead == nil {
+		hs.mixHash(ciphertext)
+		return append([]byte(nil), ciphertext...), nil
+	}
+
+	plaintext, err := hs.aead.Open(nil, hs.nonce(), ciphertext, hs.h)
+	if err != nil {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	hs.n++
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (hs *noiseHandshake) dh(local *x25519KeyExchange, remote []byte) error {
+	secret, err := local.Secret(remote)
+	if err != nil {
+		return err
+	}
+
+	return hs.mixKey(secret)
+}
+
+// es and se depend on role
+func (hs *noiseHandshake) mixToken(token noiseToken) error {
+	switch token {
+	case noiseTokenEE:
+		return hs.dh(hs.e, hs.re)
+	case noiseTokenES:
+		if hs.initiator {
+			return hs.dh(hs.e, hs.rs)
+		}
+
+		return hs.dh(hs.s, hs.re)
+	case noiseTokenSE:
+		if hs.initiator {
+			return hs.dh(hs.s, hs.re)
+		}
+
+		return hs.dh(hs.e, hs.rs)
+	}
+
+	return nil
+}
+
+// initiator writes even messages, responder writes odd messages
+func (hs *noiseHandshake) myTurn() bool {
+	return (hs.index%2 == 0) == hs.initiator
+}
+
+func (hs *noiseHandshake) finished() bool {
+	return hs.index >= len(hs.messages)
+}
+
+func (hs *noiseHandshake) writeMessage(payload []byte) ([]byte, error) {
+	if hs.finished() || !hs.myTurn() {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	var message []byte
+	for _, token := range hs.messages[hs.index] {
+		switch token {
+		case noiseTokenE:
+			e, err := newX25519KeyExchange()
+			if err != nil {
+				return nil, err
+			}
+
+			hs.e = e
+			message = append(message, e.PublicKey()...)
+			hs.mixHash(e.PublicKey())
+		case noiseTokenS:
+			message = hs.encryptAndHash(message, hs.s.PublicKey())
+		default:
+			if err := hs.mixToken(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	message = hs.encryptAndHash(message, payload)
+	hs.index++
+	return message, nil
+}
+
+func (hs *noiseHandshake) readMessage(message []byte) ([]byte, error) {
+	if hs.finished() || hs.myTurn() {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	for _, token := range hs.messages[hs.index] {
+		switch token {
+		case noiseTokenE:
+			if len(message) < noiseKeySize {
+				return nil, ErrNoiseHandshakeFailed
+			}
+
+			hs.re = append([]byte(nil), message[:noiseKeySize]...)
+			message = message[noiseKeySize:]
+			hs.mixHash(hs.re)
+		case noiseTokenS:
+			size := noiseKeySize
+			if hs.aead != nil {
+				size += hs.aead.Overhead()
+			}
+
+			if len(message) < size {
+				return nil, ErrNoiseHandshakeFailed
+			}
+
+			rs, err := hs.decryptAndHash(message[:size])
+			if err != nil {
+				return nil, err
+			}
+
+			hs.rs = rs
+			message = message[size:]
+		default:
+			if err := hs.mixToken(token); err != nil {
+				return nil, ErrNoiseHandshakeFailed
+			}
+		}
+	}
+
+	payload, err := hs.decryptAndHash(message)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.index++
+	return payload, nil
+}
+
+// Noise split gives a key for each direction, session key and nonce are expanded from it
+// with handshake hash, so they fit existing codecs
+func (hs *noiseHandshake) sessionKeys() (*sessionKeys, error) {
+	if !hs.finished() {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	initiatorKey, responderKey, err := hs.hkdf(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &sessionKeys{}
+	keys.clientKey, keys.clientNonce, err = expandSessionKey(initiatorKey, hs.h, sessionClientLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.serverKey, keys.serverNonce, err = expandSessionKey(responderKey, hs.h, sessionServerLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.confirm = make([]byte, handshakeConfirmSize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, hs.ck, hs.h, sessionConfirmLabel), keys.confirm); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (hs *noiseHandshake) statusMAC(status byte) ([]byte, error) {
+	keys, err := hs.sessionKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, keys.confirm)
+	mac.Write([]byte{status})
+	return mac.Sum(nil), nil
+}
+
+func (hs *noiseHandshake) writeStatus(status byte) ([]byte, error) {
+	mac, err := hs.statusMAC(status)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{status}, mac...), nil
+}
+
+func (hs *noiseHandshake) readStatus(message []byte) (byte, error) {
+	if len(message) != noiseStatusSize {
+		return 0, ErrNoiseHandshakeFailed
+	}
+
+	mac, err := hs.statusMAC(message[0])
+	if err != nil {
+		return 0, err
+	}
+
+	if !hmac.Equal(mac, message[1:]) {
+		return 0, ErrNoiseHandshakeFailed
+	}
+
+	return message[0], nil
+}
+
+func noiseMessage(pattern noisePattern, index int, message []byte) []byte {
+	data := make([]byte, noiseHeaderSize, noiseHeaderSize+len(message))
+	data[0] = byte(pattern)
+	data[1] = byte(index)
+	return append(data, message...)
+}
+
+func parseNoiseMessage(data []byte) (pattern noisePattern, index int, message []byte, err error) {
+	if len(data) < noiseHeaderSize || len(data) > noiseMaxMessageSize {
+		return 0, 0, nil, ErrNoiseHandshakeFailed
+	}
+
+	return noisePattern(data[0]), int(data[1]), data[noiseHeaderSize:], nil
+}
+
+func encodeNoiseClientPayload(convID uint32, cryptoTypes []CryptoType, dictIDs []uint32, fec fecConfig, bufferLen, mtu int) []byte {
+	payload := make([]byte, noiseClientPayload, noiseClientPayload+len(cryptoTypes)+1+4*len(dictIDs)+fecConfigSize+bufferLenSize+mtuSize)
+	binary.LittleEndian.PutUint32(payload, convID)
+	payload[4] = byte(len(cryptoTypes))
+	for _, tp := range cryptoTypes {
+		payload = append(payload, byte(tp))
+	}
+
+	payload = appendDictIDs(payload, dictIDs)
+	payload = appendFECConfig(payload, fec)
+	payload = appendBufferLen(payload, bufferLen)
+	return appendMTU(payload, mtu)
+}
+
+type noiseClientHello struct {
+	convID      uint32
+	cryptoTypes []CryptoType
+	dictIDs     []uint32
+	fec         fecConfig
+	bufferLen   int
+	mtu         int
+}
+
+func parseNoiseClientPayload(payload []byte) (*noiseClientHello, error) {
+	if len(payload) < noiseClientPayload {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	count := int(payload[4])
+	if count > maxHandshakeCryptoTypes || len(payload) < noiseClientPayload+count {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	p := &noiseClientHello{convID: binary.LittleEndian.Uint32(payload)}
+	for _, tp := range payload[noiseClientPayload : noiseClientPayload+count] {
+		p.cryptoTypes = append(p.cryptoTypes, CryptoType(tp))
+	}
+
+	dictIDs, n, err := parseDictIDs(payload[noiseClientPayload+count:])
+	if err != nil {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	p.dictIDs = dictIDs
+	p.fec, err = parseFECConfig(payload[noiseClientPayload+count+n:])
+	if err != nil {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	p.bufferLen, err = parseBufferLen(payload[noiseClientPayload+count+n+fecConfigSize:])
+	if err != nil {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	p.mtu, err = parseMTU(payload[noiseClientPayload+count+n+fecConfigSize+bufferLenSize:])
+	if err != nil {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	return p, nil
+}
+
+func encodeNoiseServerPayload(status byte, cryptoType CryptoType, dictID uint32, fec fecConfig, bufferLen int) []byte {
+	payload := make([]byte, 6, noiseServerPayload)
+	payload[0] = status
+	payload[1] = byte(cryptoType)
+	binary.LittleEndian.PutUint32(payload[2:], dictID)
+	payload = appendFECConfig(payload, fec)
+	return appendBufferLen(payload, bufferLen)
+}
@@ -0,0 +1,51 @@
+package gouxp
+
+import (
+	"encoding/binary"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// handshake packet from client is prefixed with key ID in plaintext:
+// | key ID: 4bytes | handshake packet |
+// server finds PSK by key ID, several PSKs can be valid at once during rotation.
+// key ID 0 with InitCryptoKey is used only when no PSK has ever been added, it's reserved
+// and can't be used for PSK
+const (
+	handshakeKeyIDSize    = 4
+	preSharedKeySize      = 32
+	defaultPreSharedKeyID = 0
+)
+
+func checkPreSharedKey(keyID uint32, key []byte) error {
+	if keyID == defaultPreSharedKeyID || len(key) != preSharedKeySize {
+		return ErrInvalidPreSharedKey
+	}
+
+	return nil
+}
+
+func putHandshakeKeyID(buffer []byte, keyID uint32) {
+	binary.LittleEndian.PutUint32(buffer, keyID)
+}
+
+func handshakeKeyID(data []byte) (uint32, error) {
+	if len(data) < handshakeKeyIDSize {
+		return 0, gokcp.ErrDataInvalid
+	}
+
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func (s *Server) preSharedKey(keyID uint32) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	// no fallback after PSK is enabled, even all keys are removed
+	if !s.pskEnabled {
+		return InitCryptoKey, keyID == defaultPreSharedKeyID
+	}
+
+	key, ok := s.preSharedKeys[keyID]
+	return key, ok
+}
@@ -5,18 +5,23 @@ import (
 )
 
 // gouxp packet format:
-// |--MAC--|--PROTO TYPE--|-----------------USER DATA-----------------|
-// | 16byte|     2byte    |                 ...                       |
-//                        |-------KCP HEADER-------|-------DATA-------|
+// |--PN--|--MAC--|--PROTO TYPE--|-----------------USER DATA-----------------|
+// | 8byte| 16byte|     2byte    |                 ...                       |
+//                               |-------KCP HEADER-------|-------DATA-------|
 
+// PN: packet number in plaintext, builds nonce and rejects replayed packets
 // MAC: check data integrity
+// PROTO TYPE: low byte is protocol type, high byte is compression type of user data
 
 // packet protocol:
 // raw data -> kcp data -> [compress] -> [crypto] -> fec
 const (
+	packetNumberSize uint16 = 8
 	macSize          uint16 = 16
 	protoSize        uint16 = 2
-	PacketHeaderSize uint16 = macSize + protoSize
+	macOffset               = packetNumberSize
+	protoOffset             = packetNumberSize + macSize
+	PacketHeaderSize uint16 = packetNumberSize + macSize + protoSize
 )
 
 type ProtoType uint16
@@ -25,12 +30,25 @@ const (
 	protoTypeHandshake ProtoType = 0x0C
 	protoTypeHeartbeat ProtoType = 0x0D
 	protoTypeData      ProtoType = 0x0E
+	// path MTU discovery
+	protoTypeMTUProbe    ProtoType = 0x0F
+	protoTypeMTUProbeACK ProtoType = 0x10
+	// runtime reconfiguration
+	protoTypeControl ProtoType = 0x11
+	// Noise Framework handshake
+	protoTypeNoiseHandshake ProtoType = 0x12
 )
 
 type PlaintextData []byte
 
+// low byte of PROTO
 func (p PlaintextData) Type() ProtoType {
-	return ProtoType(binary.LittleEndian.Uint16(p))
+	return ProtoType(binary.LittleEndian.Uint16(p) & 0xFF)
+}
+
+// high byte of PROTO
+func (p PlaintextData) Compression() CompressionType {
+	return CompressionType(binary.LittleEndian.Uint16(p) >> 8)
 }
 
 func (p PlaintextData) Data() []byte {
@@ -40,8 +58,6 @@ func (p PlaintextData) Data() []byte {
 var ConvID uint32 = 555
 
 const (
-	// | header: 18bytes | convID: 4bytes | crypto public key: 8bytes |
-	handshakeBufferSize = PacketHeaderSize + 4 + 8
 	heartbeatBufferSize = PacketHeaderSize + 4
 )
 
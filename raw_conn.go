@@ -1,7 +1,6 @@
 package gouxp
 
 import (
-	"encoding/binary"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -18,7 +17,9 @@ type RawConn struct {
 	kcp            *gokcp.KCP
 	addr           net.Addr
 	rwc            net.PacketConn
-	cryptoCodec    CryptCodec
+	cryptoEncoder  CryptCodec
+	cryptoDecoder  CryptCodec
+	cryptoType     CryptoType
 	handler        ConnHandler
 	closeC         chan struct{}
 	closed         atomic.Value
@@ -26,15 +27,122 @@ type RawConn struct {
 	stopKCPStatusC chan struct{}
 	fecEncoder     *FecCodecEncoder
 	fecDecoder     *FecCodecDecoder
+	fecConfig      fecConfig
 	lastActiveTime uint32
 	buffer         []byte
 	bufferLen      int
+	bandwidth      connBandwidth
+	congestion     CongestionController
+	sampler        congestionSampler
+	profile        KCPProfile
+	sndWnd         int
+	rcvWnd         int
+	mtuProber      mtuProber
+	reconfigurer   reconfigurer
+	keyUpdater     keyUpdater
+	fecAdapter     fecAdapter
+	// parity of partial FEC group is sent after it(ms), 0 disables it
+	fecFlushTimeout int
+	// read buffer length of remote from handshake
+	remoteBufferLen int
+	// congestion controller is set by user, profile doesn't reset it
+	customCongestion bool
+	// send side
+	compressor      Compressor
+	compressionType CompressionType
+	// zstd dictionary agreed in handshake
+	compressionDictID uint32
+	compressionDict   []byte
+	// receive side, by type in packet
+	decompressors map[CompressionType]Compressor
 	sync.Mutex
 }
 
+func (conn *RawConn) initKCP(convID uint32, profile KCPProfile) {
+	conn.kcp = gokcp.NewKCP(convID, conn.onKCPDataOutput)
+	conn.kcp.SetBufferReserved(int(PacketHeaderSize))
+	conn.sndWnd = int(gokcp.KCP_WND_SND)
+	conn.rcvWnd = int(gokcp.KCP_WND_RCV)
+	conn.setProfile(profile)
+}
+
+// congestion controller is reset by profile unless it's set by SetCongestionControl
+func (conn *RawConn) setProfile(profile KCPProfile) {
+	conn.profile = profile
+	if !conn.customCongestion {
+		if profile.NoCongestion {
+			conn.congestion = NewNoCongestion()
+		} else {
+			conn.congestion = NewKCPCongestion()
+		}
+
+		conn.sampler.reset()
+		conn.bandwidth.pacing = nil
+		conn.kcp.SetWndSize(conn.sndWnd, conn.rcvWnd)
+	}
+
+	conn.applyProfile()
+}
+
+func (conn *RawConn) applyProfile() {
+	nc := conn.profile.NoCongestion
+	if conn.congestion != nil {
+		nc = !conn.congestion.UseKCPWindow()
+	}
+
+	conn.kcp.SetNoDelay(conn.profile.NoDelay, conn.profile.Interval, conn.profile.Resend, nc)
+	conn.sampler.deadLink = conn.profile.DeadLink
+}
+
+// a segment is sent DeadLink times and still isn't acknowledged
+func (conn *RawConn) checkDeadLink() error {
+	if conn.sampler.dead {
+		return ErrDeadLink
+	}
+
+	return nil
+}
+
+// apply pacing rate and window from congestion controller
+func (conn *RawConn) updateCongestion(now uint32) {
+	if conn.congestion == nil {
+		return
+	}
+
+	rate := conn.congestion.PacingRate(now)
+	if rate <= 0 {
+		conn.bandwidth.pacing = nil
+	} else {
+		burst := rate / pacingBurstDivisor
+		if burst < int(conn.kcp.MTU()) {
+			burst = int(conn.kcp.MTU())
+		}
+
+		if conn.bandwidth.pacing == nil {
+			conn.bandwidth.pacing = NewTokenBucket(rate, burst, now)
+		} else if conn.bandwidth.pacing.Rate() != rate {
+			conn.bandwidth.pacing.SetRate(rate, burst, now)
+		}
+	}
+
+	sndWnd := conn.sndWnd
+	window := conn.congestion.Window(int(conn.kcp.MSS()))
+	if window > 0 && window < sndWnd {
+		sndWnd = window
+	}
+
+	if uint32(sndWnd) != conn.kcp.SendWnd() {
+		conn.kcp.SetWndSize(sndWnd, conn.rcvWnd)
+	}
+}
+
 func (conn *RawConn) encrypt(data []byte) (cipherData []byte, err error) {
-	if conn.cryptoCodec != nil {
-		cipherData, err = conn.cryptoCodec.Encrypt(data)
+	if conn.cryptoEncoder != nil {
+		cipherData, err = conn.cryptoEncoder.Encrypt(data)
+		if err == nil {
+			conn.markKeyPhase(cipherData)
+		}
+
 		return
 	}
 
@@ -44,12 +152,20 @@ func (conn *RawConn) encrypt(data []byte) (cipherData []byte, err error) {
 }
 
 func (conn *RawConn) decrypt(cipherData []byte) (plaintextData []byte, err error) {
-	if conn.cryptoCodec != nil {
-		plaintextData, err = conn.cryptoCodec.Decrypt(cipherData)
+	conn.keyUpdater.mx.Lock()
+	defer conn.keyUpdater.mx.Unlock()
+
+	if conn.keyUpdater.enabled {
+		plaintextData, err = conn.decryptKeyPhase(cipherData)
+		return
+	}
+
+	if conn.cryptoDecoder != nil {
+		plaintextData, err = conn.cryptoDecoder.Decrypt(cipherData)
 		return
 	}
 
-	plaintextData = cipherData[macSize:]
+	plaintextData = cipherData[protoOffset:]
 	err = nil
 	return
 }
@@ -59,16 +175,108 @@ func (conn *RawConn) write(data []byte) error {
 	return err
 }
 
+// download limit is policing, not pacing: packets over limit are dropped before decrypt
+// and KCP retransmits them, remote sender slows down by its own congestion control
+func (conn *RawConn) allowRecv(n int) bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.bandwidth.allowDownload(n, gokcp.SetupFromNowMS())
+}
+
 func (conn *RawConn) onKCPDataInput(data []byte) error {
 	conn.Lock()
 	defer conn.Unlock()
 
+	if conn.congestion != nil {
+		conn.sampler.onInput(conn.congestion, data, gokcp.SetupFromNowMS())
+	}
+
 	return conn.kcp.Input(data)
 }
 
+// pace KCP output by bandwidth limit, packets over limit wait in pending queue
+// packets without data(ACK, window probe) are never delayed, they keep remote RTT accurate
 func (conn *RawConn) onKCPDataOutput(data []byte) error {
-	binary.LittleEndian.PutUint16(data[macSize:], uint16(protoTypeData))
+	if !conn.bandwidth.uploadLimited() || !hasKCPPushSegment(data[PacketHeaderSize:]) {
+		return conn.sendKCPData(data)
+	}
+
+	now := gokcp.SetupFromNowMS()
+	if len(conn.bandwidth.pending) == 0 && conn.bandwidth.allowUpload(conn.wireSize(data), now) {
+		return conn.sendKCPData(data)
+	}
+
+	// pending queue is full, drop it and let KCP resend
+	if conn.bandwidth.pendingBytes+len(data) > int(conn.kcp.SendWnd()*conn.kcp.MTU()) {
+		return nil
+	}
 
+	conn.bandwidth.push(data)
+	return nil
+}
+
+func (conn *RawConn) flushPending() error {
+	now := gokcp.SetupFromNowMS()
+	for len(conn.bandwidth.pending) > 0 {
+		data := conn.bandwidth.pending[0]
+		if conn.bandwidth.uploadLimited() && !conn.bandwidth.allowUpload(conn.wireSize(data), now) {
+			break
+		}
+
+		err := conn.sendKCPData(data)
+		if err != nil {
+			return err
+		}
+
+		conn.bandwidth.pop()
+	}
+
+	return nil
+}
+
+// conn is locked, or isn't started. adaptive parity keeps its bounds if they fit new data shards
+func (conn *RawConn) enableFEC(cfg fecConfig) {
+	a := &conn.fecAdapter
+	if a.enabled && cfg.dataShards+a.maxParity > maxFECShards {
+		a.enabled = false
+	}
+
+	conn.fecConfig = cfg
+	a.configParity = cfg.parityShards
+	if conn.fecEncoder != nil && conn.fecDecoder != nil &&
+		conn.fecDecoder.dataShards == cfg.dataShards && conn.fecDecoder.parityShards == cfg.parityShards {
+		return
+	}
+
+	bufferSize := int(conn.kcp.MTU()) + fecHeaderSize
+	conn.fecEncoder = NewFecEncoder(cfg.dataShards, cfg.parityShards, bufferSize)
+	conn.fecDecoder = NewFecDecoder(cfg.dataShards, cfg.parityShards, bufferSize)
+	if a.enabled {
+		conn.fecEncoder.setParityShards(a.clampParity(cfg.parityShards))
+	}
+}
+
+// bytes on wire, include FEC parity shards
+func (conn *RawConn) wireSize(data []byte) int {
+	if conn.fecEncoder != nil {
+		return len(data) * (conn.fecEncoder.dataShards + conn.fecEncoder.parityShards) / conn.fecEncoder.dataShards
+	}
+
+	return len(data)
+}
+
+func (conn *RawConn) sendKCPData(data []byte) error {
+	if conn.congestion != nil {
+		conn.sampler.onOutput(conn.congestion, data[PacketHeaderSize:], gokcp.SetupFromNowMS())
+	}
+
+	// KCP segments are parsed before compression and encryption change them
+	if conn.fecEncoder != nil && conn.fecDecoder != nil && conn.fecAdapter.enabled {
+		conn.fecAdapter.onOutput(data[PacketHeaderSize:])
+	}
+
+	data = conn.compress(data)
 	cipherData, err := conn.encrypt(data)
 	if err != nil {
 		return err
@@ -98,6 +306,38 @@ func (conn *RawConn) onKCPDataOutput(data []byte) error {
 	return nil
 }
 
+// when parity of partial group is flushed, ok is false if nothing waits for it. conn is locked
+func (conn *RawConn) fecFlushTime() (flushTime uint32, ok bool) {
+	if conn.fecEncoder == nil || conn.fecDecoder == nil || conn.fecFlushTimeout <= 0 || !conn.fecEncoder.pending() {
+		return 0, false
+	}
+
+	return conn.fecEncoder.groupTime + uint32(conn.fecFlushTimeout), true
+}
+
+// invoke in update loop, conn is locked. data shards are sent, their parity waits for full group
+// at most flush timeout
+func (conn *RawConn) updateFECFlush(now uint32) error {
+	flushTime, ok := conn.fecFlushTime()
+	if !ok || int32(now-flushTime) < 0 {
+		return nil
+	}
+
+	fecData, err := conn.fecEncoder.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range fecData {
+		err = conn.write(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (conn *RawConn) recvFromKCP() error {
 	for {
 		size := conn.kcp.PeekSize()
@@ -0,0 +1,189 @@
+package gouxp
+
+import (
+	"encoding/binary"
+)
+
+// control packet format, sent out of KCP and resent until acknowledged:
+// config:     | header: 26bytes | cmd: 2bytes | seq: 4bytes | mtu: 2bytes | sndWnd: 2bytes | rcvWnd: 2bytes |
+// config ack: | header: 26bytes | cmd: 2bytes | seq: 4bytes | status: 2bytes |
+// mtu 0 means MTU is not changed
+// fec report and fec report ask aren't acknowledged, see fec_adaptive.go
+
+const (
+	controlCmdConfig       uint16 = 0x01
+	controlCmdConfigACK    uint16 = 0x02
+	controlCmdFECReport    uint16 = 0x03
+	controlCmdFECReportAsk uint16 = 0x04
+)
+
+const (
+	controlStatusAccepted uint16 = 0x00
+	controlStatusRejected uint16 = 0x01
+)
+
+const (
+	controlBufferSize   = PacketHeaderSize + 12
+	controlResendTime   = 500
+	controlResendLimit  = 5
+	controlMaxWndSize   = 0xFFFF
+	controlConfigOffset = 8
+)
+
+type reconfigRequest struct {
+	seq      uint32
+	mtu      int
+	sndWnd   int
+	rcvWnd   int
+	sentTime uint32
+	xmit     int
+}
+
+type reconfigurer struct {
+	// conn is established, changes need remote confirm
+	established bool
+	nextSeq     uint32
+	pending     *reconfigRequest
+}
+
+func (conn *RawConn) sendControl(buffer []byte) error {
+	binary.LittleEndian.PutUint16(buffer[protoOffset:], uint16(protoTypeControl))
+	cipherData, err := conn.encrypt(buffer)
+	if err != nil {
+		return err
+	}
+
+	return conn.write(cipherData)
+}
+
+func (conn *RawConn) sendReconfig(req *reconfigRequest, now uint32) error {
+	var buffer [controlBufferSize]byte
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize:], controlCmdConfig)
+	binary.LittleEndian.PutUint32(buffer[PacketHeaderSize+2:], req.seq)
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize+6:], uint16(req.mtu))
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize+controlConfigOffset:], uint16(req.sndWnd))
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize+controlConfigOffset+2:], uint16(req.rcvWnd))
+
+	req.sentTime = now
+	req.xmit++
+	return conn.sendControl(buffer[:])
+}
+
+// conn is locked, new request replaces the pending one
+func (conn *RawConn) requestReconfig(mtu int, now uint32) error {
+	r := &conn.reconfigurer
+	if r.pending != nil && mtu == 0 {
+		mtu = r.pending.mtu
+	}
+
+	r.nextSeq++
+	r.pending = &reconfigRequest{seq: r.nextSeq, mtu: mtu, sndWnd: conn.sndWnd, rcvWnd: conn.rcvWnd}
+	return conn.sendReconfig(r.pending, now)
+}
+
+// invoke in update loop, conn is locked
+func (conn *RawConn) updateReconfig(now uint32) error {
+	req := conn.reconfigurer.pending
+	if req == nil || now-req.sentTime < controlResendTime {
+		return nil
+	}
+
+	// remote doesn't answer, give up
+	if req.xmit >= controlResendLimit {
+		if logger != nil {
+			logger.Warnf("conn %v reconfig timeout, mtu: %v", conn.ID(), req.mtu)
+		}
+
+		conn.reconfigurer.pending = nil
+		return nil
+	}
+
+	return conn.sendReconfig(req, now)
+}
+
+func (conn *RawConn) onControl(data []byte) error {
+	if len(data) < 2 {
+		return ErrInvalidControl
+	}
+
+	switch binary.LittleEndian.Uint16(data) {
+	case controlCmdConfig:
+		return conn.onReconfig(data)
+	case controlCmdConfigACK:
+		return conn.onReconfigACK(data)
+	case controlCmdFECReport:
+		return conn.onFECReport(data)
+	case controlCmdFECReportAsk:
+		return conn.onFECReportAsk()
+	default:
+		return ErrInvalidControl
+	}
+}
+
+// remote wants to change MTU or window
+func (conn *RawConn) onReconfig(data []byte) error {
+	if len(data) < int(controlBufferSize-PacketHeaderSize) {
+		return ErrInvalidControl
+	}
+
+	seq := binary.LittleEndian.Uint32(data[2:])
+	mtu := int(binary.LittleEndian.Uint16(data[6:]))
+	remoteSndWnd := int(binary.LittleEndian.Uint16(data[controlConfigOffset:]))
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	status := controlStatusAccepted
+	if mtu > 0 {
+		// remote packets larger than read buffer are truncated
+		if mtu+conn.fecOverhead() >= conn.bufferLen {
+			status = controlStatusRejected
+		} else if conn.fecDecoder != nil {
+			conn.fecDecoder.setBufferSize(mtu + fecHeaderSize)
+		}
+	}
+
+	// don't let receive window throttle remote sending
+	if status == controlStatusAccepted && remoteSndWnd > conn.rcvWnd {
+		conn.rcvWnd = remoteSndWnd
+		conn.kcp.SetWndSize(int(conn.kcp.SendWnd()), conn.rcvWnd)
+	}
+
+	var buffer [controlBufferSize]byte
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize:], controlCmdConfigACK)
+	binary.LittleEndian.PutUint32(buffer[PacketHeaderSize+2:], seq)
+	binary.LittleEndian.PutUint16(buffer[PacketHeaderSize+6:], status)
+	return conn.sendControl(buffer[:])
+}
+
+func (conn *RawConn) onReconfigACK(data []byte) error {
+	if len(data) < 8 {
+		return ErrInvalidControl
+	}
+
+	seq := binary.LittleEndian.Uint32(data[2:])
+	status := binary.LittleEndian.Uint16(data[6:])
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	req := conn.reconfigurer.pending
+	if req == nil || req.seq != seq {
+		return nil
+	}
+
+	conn.reconfigurer.pending = nil
+	if status != controlStatusAccepted {
+		if logger != nil {
+			logger.Warnf("conn %v reconfig rejected by remote, mtu: %v", conn.ID(), req.mtu)
+		}
+
+		return nil
+	}
+
+	if req.mtu > 0 {
+		conn.applyMTU(req.mtu)
+	}
+
+	return nil
+}
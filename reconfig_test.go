@@ -0,0 +1,108 @@
+package gouxp
+
+import (
+	"testing"
+
+	"github.com/shaoyuan1943/gokcp"
+)
+
+// deliver control packets between conns until there are no more
+func exchangeControl(t *testing.T, a, b *RawConn, aRWC, bRWC *capturePacketConn) {
+	for i := 0; i < 10; i++ {
+		aPackets, bPackets := aRWC.take(), bRWC.take()
+		if len(aPackets) == 0 && len(bPackets) == 0 {
+			return
+		}
+
+		for _, packet := range aPackets {
+			if err := b.onControl(packet[PacketHeaderSize:]); err != nil {
+				t.Fatalf("on control err: %v", err)
+			}
+		}
+
+		for _, packet := range bPackets {
+			if err := a.onControl(packet[PacketHeaderSize:]); err != nil {
+				t.Fatalf("on control err: %v", err)
+			}
+		}
+	}
+}
+
+func TestReconfigMTU(t *testing.T) {
+	a, aRWC := newCaptureConn(4096)
+	b, bRWC := newCaptureConn(1200)
+
+	// MTU is changed at once before handshake
+	if !a.SetMTU(1000) || a.MTU() != 1000 {
+		t.Fatalf("mtu before handshake: %v", a.MTU())
+	}
+
+	if a.SetMTU(4096) || a.SetMTU(10) {
+		t.Fatalf("invalid mtu is accepted")
+	}
+
+	// after handshake MTU is changed when remote confirms it
+	a.reconfigurer.established = true
+	b.reconfigurer.established = true
+	if !a.SetMTU(1100) || a.MTU() != 1000 || a.reconfigurer.pending == nil {
+		t.Fatalf("mtu is changed before remote confirms")
+	}
+
+	exchangeControl(t, a, b, aRWC, bRWC)
+	if a.MTU() != 1100 || a.reconfigurer.pending != nil {
+		t.Fatalf("mtu isn't changed after remote confirms: %v", a.MTU())
+	}
+
+	// remote rejects MTU larger than its read buffer
+	if !a.SetMTU(1300) {
+		t.Fatalf("set mtu failed")
+	}
+
+	exchangeControl(t, a, b, aRWC, bRWC)
+	if a.MTU() != 1100 || a.reconfigurer.pending != nil {
+		t.Fatalf("mtu rejected by remote is applied: %v", a.MTU())
+	}
+
+	// MTU set by user stops discovery
+	if !a.EnableMTUDiscovery(576, 1150) || !a.SetMTU(900) || a.mtuProber.enabled {
+		t.Fatalf("mtu discovery isn't stopped by SetMTU")
+	}
+
+	// discovery drops MTU request isn't confirmed yet
+	if !a.EnableMTUDiscovery(576, 1150) {
+		t.Fatalf("enable mtu discovery failed")
+	}
+
+	exchangeControl(t, a, b, aRWC, bRWC)
+	if a.MTU() != 1100 {
+		t.Fatalf("mtu request is applied after discovery starts: %v", a.MTU())
+	}
+
+	// window request keeps pending MTU
+	a.DisableMTUDiscovery()
+	if !a.SetMTU(1000) || !a.SetWindow(256, 256) || a.reconfigurer.pending.mtu != 1000 {
+		t.Fatalf("window request drops pending mtu")
+	}
+
+	exchangeControl(t, a, b, aRWC, bRWC)
+	if a.MTU() != 1000 || b.rcvWnd != 256 {
+		t.Fatalf("mtu: %v, remote receive window: %v", a.MTU(), b.rcvWnd)
+	}
+
+	// request is resent until remote answers, then given up
+	if !a.SetMTU(900) {
+		t.Fatalf("set mtu failed")
+	}
+
+	now := gokcp.SetupFromNowMS()
+	for i := 0; i < controlResendLimit; i++ {
+		now += controlResendTime
+		if err := a.updateReconfig(now); err != nil {
+			t.Fatalf("update reconfig err: %v", err)
+		}
+	}
+
+	if len(aRWC.take()) != controlResendLimit || a.reconfigurer.pending != nil || a.MTU() != 1000 {
+		t.Fatalf("reconfig isn't given up, mtu: %v", a.MTU())
+	}
+}
@@ -0,0 +1,191 @@
+package gouxp
+
+import (
+	"sync"
+)
+
+// key update:
+// each direction is updated by its sender, sender derives next key from current one after
+// packet count or elapsed time, and flips key phase, the highest bit of PN.
+// receiver derives next key when phase flips, and keeps previous key for in flight packets.
+// key phase bit isn't authenticated, it only selects key, wrong key fails authentication
+const (
+	keyPhaseOffset      = packetNumberSize - 1
+	keyPhaseMask   byte = 0x80
+	// default update after 16M packets or 1 hour
+	defaultRekeyPackets  = 1 << 24
+	defaultRekeyInterval = 60 * 60 * 1000
+	// remote MUST see current phase before next update, or it can't tell two phases apart
+	rekeyMinInterval = 10 * 1000
+)
+
+var rekeyLabel = []byte("gouxp key update")
+
+// key and nonce of one direction
+type keyGeneration struct {
+	key   []byte
+	nonce []byte
+}
+
+func (g keyGeneration) next() (keyGeneration, error) {
+	key, nonce, err := expandSessionKey(g.key, g.nonce, rekeyLabel)
+	return keyGeneration{key: key, nonce: nonce}, err
+}
+
+type keyUpdater struct {
+	enabled    bool
+	cryptoType CryptoType
+	packets    int
+	interval   int
+	// write side, conn is locked
+	writeKeys   keyGeneration
+	writePhase  byte
+	written     int
+	updatedTime uint32
+	// read side, decoder of current phase is conn.cryptoDecoder
+	mx          sync.Mutex
+	readKeys    keyGeneration
+	readPhase   byte
+	prevDecoder CryptCodec
+	nextDecoder CryptCodec
+	nextKeys    keyGeneration
+	scratch     []byte
+}
+
+func (u *keyUpdater) setPolicy(packets, interval int) {
+	u.packets = packets
+	u.interval = interval
+}
+
+func (u *keyUpdater) due(now uint32) bool {
+	if !u.enabled || u.written == 0 || now-u.updatedTime < rekeyMinInterval {
+		return false
+	}
+
+	return (u.packets > 0 && u.written >= u.packets) || (u.interval > 0 && now-u.updatedTime >= uint32(u.interval))
+}
+
+// derived once per phase, forged packets can't make it derive again
+func (u *keyUpdater) nextReadDecoder() (CryptCodec, error) {
+	if u.nextDecoder != nil {
+		return u.nextDecoder, nil
+	}
+
+	next, err := u.readKeys.next()
+	if err != nil {
+		return nil, err
+	}
+
+	u.nextDecoder = createCryptoCodec(u.cryptoType)
+	u.nextDecoder.SetKey(next.key)
+	u.nextDecoder.SetReadNonce(next.nonce)
+	u.nextKeys = next
+	return u.nextDecoder, nil
+}
+
+// install chosen codec with session keys, nil keys if no crypto. conn is locked
+func (conn *RawConn) installSessionCodecs(tp CryptoType, write, read keyGeneration, now uint32) {
+	u := &conn.keyUpdater
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	conn.cryptoEncoder, conn.cryptoDecoder = nil, nil
+	if tp != UseNoCrypto {
+		conn.cryptoEncoder, conn.cryptoDecoder = newSessionCodecs(tp, write.key, write.nonce, read.key, read.nonce)
+	}
+
+	conn.cryptoType = tp
+	u.enabled = conn.cryptoEncoder != nil
+	u.cryptoType = tp
+	u.writeKeys = write
+	u.writePhase = 0
+	u.written = 0
+	u.updatedTime = now
+	u.readKeys = read
+	u.readPhase = 0
+	u.prevDecoder = nil
+	u.nextDecoder = nil
+}
+
+// invoke in update loop, conn is locked
+func (conn *RawConn) updateRekey(now uint32) error {
+	u := &conn.keyUpdater
+	if !u.due(now) {
+		return nil
+	}
+
+	next, err := u.writeKeys.next()
+	if err != nil {
+		return err
+	}
+
+	encoder := createCryptoCodec(u.cryptoType)
+	encoder.SetKey(next.key)
+	encoder.SetWriteNonce(next.nonce)
+
+	conn.cryptoEncoder = encoder
+	u.writeKeys = next
+	u.writePhase ^= 1
+	u.written = 0
+	u.updatedTime = now
+	return nil
+}
+
+// conn is locked
+func (conn *RawConn) markKeyPhase(cipherData []byte) {
+	u := &conn.keyUpdater
+	if !u.enabled {
+		return
+	}
+
+	cipherData[keyPhaseOffset] |= u.writePhase << 7
+	u.written++
+}
+
+// u.mx is locked
+func (conn *RawConn) decryptKeyPhase(cipherData []byte) (plaintextData []byte, err error) {
+	u := &conn.keyUpdater
+	if len(cipherData) < int(packetNumberSize) {
+		return nil, ErrMessageAuthFailed
+	}
+
+	phase := cipherData[keyPhaseOffset] >> 7
+	cipherData[keyPhaseOffset] &^= keyPhaseMask
+	if phase == u.readPhase {
+		return conn.cryptoDecoder.Decrypt(cipherData)
+	}
+
+	// late packet of previous phase or first packet of next phase,
+	// failed decryption may overwrite data, keep a copy for second try
+	u.scratch = append(u.scratch[:0], cipherData...)
+	var prevErr error
+	if u.prevDecoder != nil {
+		plaintextData, prevErr = u.prevDecoder.Decrypt(cipherData)
+		if prevErr == nil {
+			return plaintextData, nil
+		}
+
+		copy(cipherData, u.scratch)
+	}
+
+	decoder, err := u.nextReadDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintextData, err = decoder.Decrypt(cipherData)
+	if err != nil {
+		if prevErr == ErrReplayedPacket {
+			return nil, prevErr
+		}
+
+		return nil, err
+	}
+
+	u.prevDecoder = conn.cryptoDecoder
+	conn.cryptoDecoder = decoder
+	u.nextDecoder = nil
+	u.readKeys = u.nextKeys
+	u.readPhase = phase
+	return plaintextData, nil
+}
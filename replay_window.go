@@ -0,0 +1,84 @@
+package gouxp
+
+import (
+	"sync"
+)
+
+// packets older than window are rejected, KCP and FEC reorder is far less than it
+const (
+	replayWindowSize  = 2048
+	replayWindowWords = replayWindowSize / 64
+)
+
+// sliding window of received packet numbers
+type replayWindow struct {
+	mx       sync.Mutex
+	received bool
+	max      uint64
+	bitmap   [replayWindowWords]uint64
+}
+
+func (w *replayWindow) reset() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	w.received = false
+	w.max = 0
+	w.bitmap = [replayWindowWords]uint64{}
+}
+
+func (w *replayWindow) bit(pn uint64) (*uint64, uint64) {
+	index := pn / 64 % replayWindowWords
+	return &w.bitmap[index], 1 << (pn % 64)
+}
+
+// check before authentication, packet is new and not too old
+func (w *replayWindow) check(pn uint64) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if !w.received || pn > w.max {
+		return true
+	}
+
+	if w.max-pn >= replayWindowSize-64 {
+		return false
+	}
+
+	word, mask := w.bit(pn)
+	return *word&mask == 0
+}
+
+// update after authentication, forged packets can't move window
+func (w *replayWindow) update(pn uint64) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if !w.received {
+		w.received = true
+		w.max = pn
+		w.bitmap = [replayWindowWords]uint64{}
+	} else if pn > w.max {
+		// clear words between old max and new max, none if new max is in the same word
+		from, to := w.max/64+1, pn/64
+		if to >= from && to-from >= replayWindowWords {
+			w.bitmap = [replayWindowWords]uint64{}
+		} else {
+			for i := from; i <= to; i++ {
+				w.bitmap[i%replayWindowWords] = 0
+			}
+		}
+
+		w.max = pn
+	} else if w.max-pn >= replayWindowSize-64 {
+		return false
+	}
+
+	word, mask := w.bit(pn)
+	if *word&mask != 0 {
+		return false
+	}
+
+	*word |= mask
+	return true
+}
@@ -31,6 +31,7 @@ func main() {
 	// client.SetMTU
 	// client.SetUpdateInterval
 	// client.SetWindow
+	// client.ApplyKCPProfile
 	// client.UseCryptoCodec
 	// client.EnableFEC
 	client.Start()
@@ -25,6 +25,7 @@ func (s *Server) OnNewConnComing(conn *gouxp.ServerConn) {
 	// session.SetMTU
 	// session.SetUpdateInterval
 	// session.SetWindow
+	// session.ApplyKCPProfile
 	// session.UseCryptoCodec
 	// session.EnableFEC
 }
@@ -48,6 +49,7 @@ func main() {
 	server.Server = gouxp.NewServer(conn, server, 2, 16836) // bufferLen: 16K
 
 	// server.UseCryptoCodec
+	// server.SetKCPProfile
 	server.Start()
 
 	// server.Close
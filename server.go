@@ -1,7 +1,7 @@
 package gouxp
 
 import (
-	"encoding/binary"
+	"crypto/ed25519"
 	"errors"
 	"net"
 	"runtime"
@@ -9,28 +9,234 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/shaoyuan1943/gouxp/dh64"
-
 	"github.com/shaoyuan1943/gokcp"
 )
 
 type Server struct {
-	rwc            net.PacketConn
-	handler        ServerHandler
-	allConn        map[string]*ServerConn
-	closeC         chan struct{}
-	scheduler      *TimerScheduler
-	started        int64
-	connCryptoType CryptoType
-	bufferLen      int
+	rwc           net.PacketConn
+	handler       ServerHandler
+	allConn       map[string]*ServerConn
+	closeC        chan struct{}
+	scheduler     *TimerScheduler
+	started       int64
+	cryptoTypes   []CryptoType
+	bufferLen     int
+	kcpProfile    KCPProfile
+	uploadLimit   int
+	downloadLimit int
+	rebalanceC    chan struct{}
+	preSharedKeys map[uint32][]byte
+	pskEnabled    bool
+	identityKey   ed25519.PrivateKey
+	rekeyPackets  int
+	rekeyInterval int
+	noiseKey      []byte
+	pendingNoise  map[string]*pendingNoise
+	clientKeyring ClientKeyring
+	dicts         compressionDicts
+	fecConfig     fecConfig
 	sync.Mutex
 }
 
-func (s *Server) UseCryptoCodec(cryptoType CryptoType) {
+func (s *Server) UseCryptoCodec(cryptoType CryptoType) error {
+	return s.UseCryptoCodecs(cryptoType)
+}
+
+// crypto types server accepts in preference order, server chooses the first one client supports.
+// UseNoCrypto allows clients without crypto, default is UseNoCrypto only
+func (s *Server) UseCryptoCodecs(cryptoTypes ...CryptoType) error {
+	err := checkCryptoTypes(cryptoTypes)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.cryptoTypes = append([]CryptoType(nil), cryptoTypes...)
+	return nil
+}
+
+// PSK protects handshake, client uses one of them by key ID. keys can be added and removed at
+// any time for rotation, key MUST be 32bytes and key ID 0 is reserved. once any PSK is added,
+// default key is never used again, handshake with unknown key ID is rejected
+func (s *Server) AddPreSharedKey(keyID uint32, key []byte) error {
+	err := checkPreSharedKey(keyID, key)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.preSharedKeys == nil {
+		s.preSharedKeys = make(map[uint32][]byte)
+	}
+
+	s.pskEnabled = true
+
+	s.preSharedKeys[keyID] = append([]byte(nil), key...)
+	return nil
+}
+
+func (s *Server) RemovePreSharedKey(keyID uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.preSharedKeys, keyID)
+}
+
+// long-term Ed25519 key, handshake response is signed by it and clients verify it with
+// the public key. MUST invoke before start
+func (s *Server) SetIdentityKey(key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return ErrInvalidIdentityKey
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.identityKey = key
+	return nil
+}
+
+// X25519 static key of Noise handshake, clients using Noise NK or XX are accepted when it is set.
+// MUST invoke before start
+func (s *Server) SetNoiseStaticKey(key []byte) error {
+	err := checkNoiseKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.noiseKey = append([]byte(nil), key...)
+	return nil
+}
+
+// clients MUST prove Ed25519 key or Noise XX static key in handshake, and keyring accepts it.
+// keyring is invoked in handshake, it SHOULD return fast. only crypto types which authenticate
+// packets are chosen, client offering none of them is rejected. MUST invoke before start
+func (s *Server) SetClientKeyring(keyring ClientKeyring) {
 	s.Lock()
 	defer s.Unlock()
 
-	s.connCryptoType = cryptoType
+	s.clientKeyring = keyring
+}
+
+// zstd dictionary for UseZstdDict, trained by TrainCompressionDict. dictionaries are in preference
+// order, server chooses the first one client has. invoke before clients connect
+func (s *Server) AddCompressionDict(dict []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.dicts.add(dict)
+}
+
+// FEC with FECDataShards and FECParityShards for new connections
+func (s *Server) EnableFEC() error {
+	return s.EnableFECWithConfig(FECDataShards, FECParityShards)
+}
+
+// FEC of new connections, client asking for other valid shards in handshake uses its shards.
+// both sides enable FEC when handshake is done. KCP MTU with FEC header MUST fit read buffer
+func (s *Server) EnableFECWithConfig(dataShards, parityShards int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	err := checkFECConfig(dataShards, parityShards, int(gokcp.KCP_MTU_DEF), s.bufferLen)
+	if err != nil {
+		return err
+	}
+
+	s.fecConfig = fecConfig{dataShards: dataShards, parityShards: parityShards}
+	return nil
+}
+
+// key update policy of new connections, see RawConn.SetRekeyPolicy
+func (s *Server) SetRekeyPolicy(packets, interval int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.rekeyPackets = packets
+	s.rekeyInterval = interval
+}
+
+// aggregate upload and download limit of all connections, bytes per second, 0 is unlimited
+// capacity is divided fairly between active connections
+func (s *Server) SetBandwidth(upload, download int) {
+	s.Lock()
+	s.uploadLimit = upload
+	s.downloadLimit = download
+	if s.rebalanceC == nil && (upload > 0 || download > 0) {
+		s.rebalanceC = make(chan struct{})
+		go s.rebalanceBandwidthLoop(s.rebalanceC)
+	}
+	s.Unlock()
+
+	s.rebalanceBandwidth()
+}
+
+func (s *Server) rebalanceBandwidthLoop(stopC chan struct{}) {
+	ticker := time.NewTicker(bandwidthRebalanceInterval * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeC:
+			return
+		case <-stopC:
+			return
+		case <-ticker.C:
+			s.rebalanceBandwidth()
+		}
+	}
+}
+
+func (s *Server) rebalanceBandwidth() {
+	s.Lock()
+	upload := s.uploadLimit
+	download := s.downloadLimit
+	tmp := make([]*ServerConn, 0, len(s.allConn))
+	for _, conn := range s.allConn {
+		tmp = append(tmp, conn)
+	}
+
+	if upload <= 0 && download <= 0 && s.rebalanceC != nil {
+		close(s.rebalanceC)
+		s.rebalanceC = nil
+	}
+	s.Unlock()
+
+	now := gokcp.SetupFromNowMS()
+	active := make([]bool, len(tmp))
+	activeCount := 0
+	for i, conn := range tmp {
+		active[i] = conn.isActive(now)
+		if active[i] {
+			activeCount++
+		}
+	}
+
+	idleCount := len(tmp) - activeCount
+	activeUpload, idleUpload := bandwidthShares(upload, activeCount, idleCount)
+	activeDownload, idleDownload := bandwidthShares(download, activeCount, idleCount)
+	for i, conn := range tmp {
+		if active[i] {
+			conn.setBandwidthShare(activeUpload, activeDownload)
+		} else {
+			conn.setBandwidthShare(idleUpload, idleDownload)
+		}
+	}
+}
+
+// KCP profile of new connections
+func (s *Server) SetKCPProfile(profile KCPProfile) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.kcpProfile = profile
 }
 
 func (s *Server) waiting4Start() {
@@ -105,40 +311,100 @@ func (s *Server) readRawDataLoop() {
 }
 
 func (s *Server) onNewConnection(addr net.Addr, data []byte) (*ServerConn, error) {
+	s.Lock()
+	cryptoTypes, identityKey, keyring := s.cryptoTypes, s.identityKey, s.clientKeyring
+	dicts, fec, bufferLen := s.dicts, s.fecConfig, s.bufferLen
+	s.Unlock()
+
+	cryptoTypes = clientAuthCryptoTypes(keyring, cryptoTypes)
+
+	keyID, err := handshakeKeyID(data)
+	if err != nil {
+		return nil, err
+	}
+
+	psk, ok := s.preSharedKey(keyID)
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
 	conn := &ServerConn{}
-	conn.cryptoCodec = createCryptoCodec(s.connCryptoType)
-	plaintextData, err := conn.decrypt(data)
+	conn.cryptoEncoder, conn.cryptoDecoder = newHandshakeCodecs(psk)
+	plaintextData, err := conn.decrypt(data[handshakeKeyIDSize:])
 	if err != nil {
 		return nil, err
 	}
 
 	protoType := PlaintextData(plaintextData).Type()
+	if protoType == protoTypeNoiseHandshake {
+		return s.onNoiseHandshake(conn, addr, PlaintextData(plaintextData).Data())
+	}
+
 	if protoType != protoTypeHandshake {
 		return nil, ErrUnknownProtocolType
 	}
 
-	logicData := PlaintextData(plaintextData).Data()
-	convID := binary.LittleEndian.Uint32(logicData)
+	hello, helloData, err := parseClientHello(PlaintextData(plaintextData).Data())
+	if err != nil {
+		return nil, err
+	}
+
+	convID := hello.convID
 	if convID == 0 {
 		return nil, gokcp.ErrDataInvalid
 	}
 
-	var nonce [8]byte
-	var handshakeRspBuffer [PacketHeaderSize + 8]byte
-	binary.LittleEndian.PutUint16(handshakeRspBuffer[macSize:], uint16(protoTypeHandshake))
-	if conn.cryptoCodec != nil {
-		clientPublicKey := binary.LittleEndian.Uint64(logicData[4:])
-		if clientPublicKey == 0 {
-			return nil, gokcp.ErrDataInvalid
+	// tell client why handshake failed
+	rsp := &serverHello{status: handshakeStatusAccepted, bufferLen: bufferLen}
+	reject := func(status byte) {
+		rsp.status = status
+		cipherData, err := conn.encrypt(handshakePacket(protoTypeHandshake, rsp.encode()))
+		if err == nil {
+			s.rwc.WriteTo(cipherData, addr)
+		}
+	}
+
+	if hello.identity != nil && !verifyClientIdentity(hello.identity.PublicKey, helloData[:len(helloData)-identitySignatureSize], hello.signature) {
+		if logger != nil {
+			logger.Warnf("handshake from %v rejected, client signature is invalid", addr)
+		}
+
+		reject(handshakeStatusAuthFailed)
+		return nil, ErrClientAuthFailed
+	}
+
+	if !checkClientIdentity(keyring, hello.identity) {
+		if logger != nil {
+			logger.Warnf("handshake from %v rejected, client key isn't accepted", addr)
+		}
+
+		reject(handshakeStatusAuthFailed)
+		return nil, ErrClientAuthFailed
+	}
+
+	cryptoType, ok := chooseCryptoType(cryptoTypes, hello.cryptoTypes)
+	if !ok {
+		if logger != nil {
+			logger.Warnf("handshake from %v rejected, crypto types: %v, server supports: %v", addr, hello.cryptoTypes, cryptoTypes)
 		}
 
-		serverPrivateKey, serverPublicKey := dh64.KeyPair()
-		num := dh64.Secret(serverPrivateKey, clientPublicKey)
-		binary.LittleEndian.PutUint64(nonce[:], num)
-		binary.LittleEndian.PutUint64(handshakeRspBuffer[PacketHeaderSize:], serverPublicKey)
+		reject(handshakeStatusCryptoMismatch)
+		return nil, ErrCryptoNegotiationFailed
+	}
+
+	rsp.cryptoType = cryptoType
+	rsp.dictID = dicts.choose(hello.dictIDs)
+	rsp.fec = chooseFECConfig(fec, hello.fec, fecHandshakeMTU(hello.mtu), fecBufferLen(bufferLen, hello.bufferLen))
+	rspData, keys, err := serverKeyExchange(rsp, hello.publicKey, helloData)
+	if err != nil {
+		return nil, err
+	}
+
+	if identityKey != nil {
+		copy(rspData[serverHelloSignedSize:], signIdentity(identityKey, helloData, rspData[:serverHelloSignedSize]))
 	}
 
-	cipherData, err := conn.encrypt(handshakeRspBuffer[:])
+	cipherData, err := conn.encrypt(handshakePacket(protoTypeHandshake, rspData))
 	if err != nil {
 		return nil, err
 	}
@@ -148,34 +414,274 @@ func (s *Server) onNewConnection(addr net.Addr, data []byte) (*ServerConn, error
 		return nil, err
 	}
 
-	if conn.cryptoCodec != nil {
-		conn.cryptoCodec.SetReadNonce(nonce[:])
-		conn.cryptoCodec.SetWriteNonce(nonce[:])
+	var writeKeys, readKeys keyGeneration
+	if cryptoType != UseNoCrypto {
+		writeKeys = keyGeneration{key: keys.serverKey, nonce: keys.serverNonce}
+		readKeys = keyGeneration{key: keys.clientKey, nonce: keys.clientNonce}
 	}
 
+	if hello.identity != nil {
+		conn.clientIdentity = &ClientIdentity{KeyType: hello.identity.KeyType, PublicKey: append([]byte(nil), hello.identity.PublicKey...)}
+	}
+
+	conn.compressionDictID, conn.compressionDict = rsp.dictID, dicts.get(rsp.dictID)
+	conn.fecConfig = rsp.fec
+	conn.remoteBufferLen = hello.bufferLen
+	s.establishConnection(conn, addr, convID, cryptoType, writeKeys, readKeys)
+	return conn, nil
+}
+
+// handshake is done, install session codecs and start conn
+func (s *Server) establishConnection(conn *ServerConn, addr net.Addr, convID uint32, cryptoType CryptoType, writeKeys, readKeys keyGeneration) {
+	s.Lock()
+	rekeyPackets, rekeyInterval := s.rekeyPackets, s.rekeyInterval
+	s.Unlock()
+
+	conn.installSessionCodecs(cryptoType, writeKeys, readKeys, gokcp.SetupFromNowMS())
+	conn.keyUpdater.setPolicy(rekeyPackets, rekeyInterval)
+	conn.fecFlushTimeout = defaultFECFlushTimeout
 	conn.convID = convID
 	conn.server = s
 	conn.rwc = s.rwc
 	conn.addr = addr
-	conn.kcp = gokcp.NewKCP(convID, conn.onKCPDataOutput)
-	conn.kcp.SetBufferReserved(int(PacketHeaderSize))
-	conn.kcp.SetNoDelay(true, 10, 2, true)
+	conn.initKCP(convID, s.kcpProfile)
 	conn.closed.Store(false)
 	conn.connCloser = conn
 	conn.closeC = make(chan struct{})
 	conn.buffer = make([]byte, s.bufferLen)
 	conn.bufferLen = s.bufferLen
+	if conn.fecConfig.dataShards > 0 {
+		conn.enableFEC(conn.fecConfig)
+	}
+
+	conn.reconfigurer.established = true
+
+	s.Lock()
+	n := len(s.allConn) + 1
+	upload, download := s.uploadLimit/n, s.downloadLimit/n
+	s.Unlock()
+	conn.setBandwidthShare(upload, download)
 
 	conn.onHandshake()
 	s.handler.OnNewConnComing(conn)
-	return conn, nil
+}
+
+// returns nil conn when XX handshake waits for last message
+func (s *Server) onNoiseHandshake(conn *ServerConn, addr net.Addr, data []byte) (*ServerConn, error) {
+	s.Lock()
+	noiseKey, cryptoTypes, keyring, dicts, fec := s.noiseKey, s.cryptoTypes, s.clientKeyring, s.dicts, s.fecConfig
+	bufferLen := s.bufferLen
+	s.Unlock()
+
+	cryptoTypes = clientAuthCryptoTypes(keyring, cryptoTypes)
+	if noiseKey == nil {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	pattern, index, message, err := parseNoiseMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// last message of XX, client sends its static key
+	if index == 2 {
+		pending := s.takePendingNoise(addr)
+		if pending == nil || pending.hs.pattern != pattern {
+			return nil, ErrNoiseHandshakeFailed
+		}
+
+		_, err = pending.hs.readMessage(message)
+		if err != nil {
+			return nil, err
+		}
+
+		// client waits for the result before it establishes
+		conn.cryptoEncoder = pending.encoder
+		status := handshakeStatusAccepted
+		identity := &ClientIdentity{KeyType: ClientKeyX25519, PublicKey: pending.hs.rs}
+		if !checkClientIdentity(keyring, identity) {
+			if logger != nil {
+				logger.Warnf("noise handshake from %v rejected, client key isn't accepted", addr)
+			}
+
+			status = handshakeStatusAuthFailed
+		}
+
+		reply, err := pending.hs.writeStatus(status)
+		if err != nil {
+			return nil, err
+		}
+
+		cipherData, err := conn.encrypt(handshakePacket(protoTypeNoiseHandshake, noiseMessage(pattern, noiseStatusIndex, reply)))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s.rwc.WriteTo(cipherData, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if status != handshakeStatusAccepted {
+			return nil, ErrClientAuthFailed
+		}
+
+		conn.clientIdentity = identity
+		return conn, s.establishNoise(conn, addr, pending)
+	}
+
+	if index != 0 {
+		return nil, ErrNoiseHandshakeFailed
+	}
+
+	hs, err := newNoiseHandshake(pattern, false, noiseKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := hs.readMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	clientPayload, err := parseNoiseClientPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	convID, clientTypes := clientPayload.convID, clientPayload.cryptoTypes
+	if convID == 0 {
+		return nil, gokcp.ErrDataInvalid
+	}
+
+	// tell client why handshake failed
+	status := handshakeStatusAccepted
+	cryptoType, ok := chooseCryptoType(cryptoTypes, clientTypes)
+	rejectErr := ErrCryptoNegotiationFailed
+	if !ok {
+		if logger != nil {
+			logger.Warnf("noise handshake from %v rejected, crypto types: %v, server supports: %v", addr, clientTypes, cryptoTypes)
+		}
+
+		status = handshakeStatusCryptoMismatch
+	}
+
+	// NK client has no static key
+	if ok && pattern == noiseNK && !checkClientIdentity(keyring, nil) {
+		if logger != nil {
+			logger.Warnf("noise handshake from %v rejected, client key is required", addr)
+		}
+
+		ok, rejectErr = false, ErrClientAuthFailed
+		status = handshakeStatusAuthFailed
+	}
+
+	dictID := dicts.choose(clientPayload.dictIDs)
+	fec = chooseFECConfig(fec, clientPayload.fec, fecHandshakeMTU(clientPayload.mtu), fecBufferLen(bufferLen, clientPayload.bufferLen))
+	reply, err := hs.writeMessage(encodeNoiseServerPayload(status, cryptoType, dictID, fec, bufferLen))
+	if err != nil {
+		return nil, err
+	}
+
+	cipherData, err := conn.encrypt(handshakePacket(protoTypeNoiseHandshake, noiseMessage(pattern, 1, reply)))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.rwc.WriteTo(cipherData, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, rejectErr
+	}
+
+	pending := &pendingNoise{hs: hs, convID: convID, cryptoType: cryptoType, dictID: dictID, fec: fec,
+		bufferLen: clientPayload.bufferLen, createTime: gokcp.SetupFromNowMS(), encoder: conn.cryptoEncoder}
+	if !hs.finished() {
+		s.addPendingNoise(addr, pending)
+		return nil, nil
+	}
+
+	return conn, s.establishNoise(conn, addr, pending)
+}
+
+func (s *Server) establishNoise(conn *ServerConn, addr net.Addr, pending *pendingNoise) error {
+	var writeKeys, readKeys keyGeneration
+	if pending.cryptoType != UseNoCrypto {
+		keys, err := pending.hs.sessionKeys()
+		if err != nil {
+			return err
+		}
+
+		writeKeys = keyGeneration{key: keys.serverKey, nonce: keys.serverNonce}
+		readKeys = keyGeneration{key: keys.clientKey, nonce: keys.clientNonce}
+	}
+
+	s.Lock()
+	conn.compressionDict = s.dicts.get(pending.dictID)
+	s.Unlock()
+
+	conn.remoteStaticKey = pending.hs.rs
+	conn.compressionDictID = pending.dictID
+	conn.fecConfig = pending.fec
+	conn.remoteBufferLen = pending.bufferLen
+	s.establishConnection(conn, addr, pending.convID, pending.cryptoType, writeKeys, readKeys)
+	return nil
+}
+
+// expired handshakes are removed, the oldest one is evicted when too many are pending,
+// so flood of first messages can't block new handshakes
+func (s *Server) addPendingNoise(addr net.Addr, pending *pendingNoise) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pendingNoise == nil {
+		s.pendingNoise = make(map[string]*pendingNoise)
+	}
+
+	var oldest string
+	var oldestAge uint32
+	for k, v := range s.pendingNoise {
+		age := pending.createTime - v.createTime
+		if age > noisePendingTimeout {
+			delete(s.pendingNoise, k)
+		} else if oldest == "" || age > oldestAge {
+			oldest, oldestAge = k, age
+		}
+	}
+
+	key := addr.String()
+	if _, ok := s.pendingNoise[key]; !ok && len(s.pendingNoise) >= maxPendingNoise {
+		delete(s.pendingNoise, oldest)
+	}
+
+	s.pendingNoise[key] = pending
+}
+
+func (s *Server) takePendingNoise(addr net.Addr) *pendingNoise {
+	s.Lock()
+	defer s.Unlock()
+
+	pending, ok := s.pendingNoise[addr.String()]
+	if !ok {
+		return nil
+	}
+
+	delete(s.pendingNoise, addr.String())
+	if gokcp.SetupFromNowMS()-pending.createTime > noisePendingTimeout {
+		return nil
+	}
+
+	return pending
 }
 
 func (s *Server) onRecvRawData(addr net.Addr, data []byte) {
 	conn := s.findConnection(addr)
 	if conn == nil {
 		newConn, err := s.onNewConnection(addr, data)
-		if err != nil {
+		if err != nil || newConn == nil {
 			return
 		}
 
@@ -184,6 +690,9 @@ func (s *Server) onRecvRawData(addr net.Addr, data []byte) {
 	}
 
 	atomic.StoreUint32(&conn.lastActiveTime, gokcp.SetupFromNowMS())
+	if !conn.allowRecv(len(data)) {
+		return
+	}
 
 	var err error
 	defer func() {
@@ -195,18 +704,32 @@ func (s *Server) onRecvRawData(addr net.Addr, data []byte) {
 	parseData := func(targetData []byte) error {
 		plaintextData, parseErr := conn.decrypt(targetData)
 		if parseErr != nil {
+			// duplicated packet from network, drop it
+			if parseErr == ErrReplayedPacket {
+				return nil
+			}
+
 			return parseErr
 		}
 
 		protoType := PlaintextData(plaintextData).Type()
-		logicData := PlaintextData(plaintextData).Data()
+		logicData, parseErr := conn.decompress(PlaintextData(plaintextData))
+		if parseErr != nil {
+			return parseErr
+		}
 		switch protoType {
-		case protoTypeHandshake:
+		case protoTypeHandshake, protoTypeNoiseHandshake:
 			parseErr = ErrExistConnection
 		case protoTypeHeartbeat:
 			parseErr = conn.onHeartbeat(logicData)
 		case protoTypeData:
 			parseErr = conn.onKCPDataInput(logicData)
+		case protoTypeMTUProbe:
+			parseErr = conn.onMTUProbe(logicData)
+		case protoTypeMTUProbeACK:
+			parseErr = conn.onMTUProbeACK(logicData)
+		case protoTypeControl:
+			parseErr = conn.onControl(logicData)
 		default:
 			parseErr = ErrUnknownProtocolType
 		}
@@ -280,12 +803,16 @@ func (s *Server) Start() {
 
 func NewServer(rwc net.PacketConn, handler ServerHandler, parallelCount uint32, bufferLen int) *Server {
 	s := &Server{
-		rwc:       rwc,
-		handler:   handler,
-		allConn:   make(map[string]*ServerConn),
-		closeC:    make(chan struct{}),
-		scheduler: NewTimerScheduler(parallelCount),
-		bufferLen: bufferLen,
+		rwc:           rwc,
+		handler:       handler,
+		allConn:       make(map[string]*ServerConn),
+		closeC:        make(chan struct{}),
+		scheduler:     NewTimerScheduler(parallelCount),
+		bufferLen:     bufferLen,
+		kcpProfile:    defaultKCPProfile,
+		cryptoTypes:   []CryptoType{UseNoCrypto},
+		rekeyPackets:  defaultRekeyPackets,
+		rekeyInterval: defaultRekeyInterval,
 	}
 
 	go s.readRawDataLoop()
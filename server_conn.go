@@ -12,8 +12,10 @@ import (
 
 type ServerConn struct {
 	RawConn
-	convID uint32
-	server *Server
+	convID          uint32
+	server          *Server
+	remoteStaticKey []byte
+	clientIdentity  *ClientIdentity
 }
 
 func (conn *ServerConn) onHandshake() {
@@ -69,19 +71,67 @@ func (conn *ServerConn) update() {
 		return
 	}
 
+	now := gokcp.SetupFromNowMS()
+	conn.updateCongestion(now)
+	err = conn.updateMTUProbe(now)
+	if err != nil {
+		return
+	}
+
+	err = conn.updateReconfig(now)
+	if err != nil {
+		return
+	}
+
+	err = conn.updateRekey(now)
+	if err != nil {
+		return
+	}
+
+	err = conn.updateFECReport(now)
+	if err != nil {
+		return
+	}
+
+	err = conn.updateFECFlush(now)
+	if err != nil {
+		return
+	}
+
 	err = conn.kcp.Update()
 	if err != nil {
 		return
 	}
 
+	err = conn.checkDeadLink()
+	if err != nil {
+		return
+	}
+
+	err = conn.flushPending()
+	if err != nil {
+		return
+	}
+
 	nextTime := conn.kcp.Check()
+	if len(conn.bandwidth.pending) > 0 {
+		pendingTime := now + conn.bandwidth.uploadDelay(now)
+		if pendingTime < nextTime {
+			nextTime = pendingTime
+		}
+	}
+
+	if flushTime, ok := conn.fecFlushTime(); ok && flushTime < nextTime {
+		nextTime = flushTime
+	}
+
 	conn.server.scheduler.PushTask(conn.update, nextTime)
 }
 
 // response
 func (conn *ServerConn) onHeartbeat(data []byte) error {
 	var heartbeatBuffer [heartbeatBufferSize]byte
-	binary.LittleEndian.PutUint16(heartbeatBuffer[macSize:], uint16(protoTypeHeartbeat))
+	binary.LittleEndian.PutUint16(heartbeatBuffer[protoOffset:], uint16(protoTypeHeartbeat))
 	binary.LittleEndian.PutUint32(heartbeatBuffer[PacketHeaderSize:], gokcp.SetupFromNowMS())
 
 	conn.Lock()
@@ -0,0 +1,83 @@
+package gouxp
+
+// TokenBucket limits how many bytes can pass per second.
+// rate: bytes per second, burst: max bytes can be taken at once
+// TokenBucket is not goroutine safe, the owner should hold its lock.
+type TokenBucket struct {
+	rate     int
+	burst    int
+	tokens   float64
+	lastTime uint32
+}
+
+func NewTokenBucket(rate, burst int, now uint32) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetRate(rate, burst, now)
+	b.tokens = float64(b.burst)
+	return b
+}
+
+func (b *TokenBucket) SetRate(rate, burst int, now uint32) {
+	b.refill(now)
+	if burst <= 0 {
+		burst = rate
+	}
+
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
+
+func (b *TokenBucket) Rate() int {
+	return b.rate
+}
+
+func (b *TokenBucket) refill(now uint32) {
+	if b.lastTime == 0 || now <= b.lastTime {
+		b.lastTime = now
+		return
+	}
+
+	b.tokens += float64(b.rate) * float64(now-b.lastTime) / 1000
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+
+	b.lastTime = now
+}
+
+// packet larger than burst is allowed when bucket is full, bucket will be in debt
+func (b *TokenBucket) need(n int) float64 {
+	if n > b.burst {
+		return float64(b.burst)
+	}
+
+	return float64(n)
+}
+
+func (b *TokenBucket) Allow(n int, now uint32) bool {
+	b.refill(now)
+	return b.tokens >= b.need(n)
+}
+
+func (b *TokenBucket) Take(n int, now uint32) {
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// how long(ms) to wait for n bytes
+func (b *TokenBucket) Delay(n int, now uint32) uint32 {
+	b.refill(now)
+	lack := b.need(n) - b.tokens
+	if lack <= 0 {
+		return 0
+	}
+
+	if b.rate <= 0 {
+		return 1000
+	}
+
+	return uint32(lack*1000/float64(b.rate)) + 1
+}
@@ -0,0 +1,120 @@
+package gouxp
+
+import (
+	"testing"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// 1000 bytes per second, burst 100 bytes
+	now := uint32(1000)
+	b := NewTokenBucket(1000, 100, now)
+	if !b.Allow(100, now) {
+		t.Fatalf("new bucket should be full")
+	}
+
+	b.Take(100, now)
+	if b.Allow(1, now) {
+		t.Fatalf("empty bucket allows data")
+	}
+
+	if d := b.Delay(50, now); d < 50 || d > 51 {
+		t.Fatalf("delay of 50 bytes: %v, want 50ms", d)
+	}
+
+	now += 50
+	if !b.Allow(50, now) || b.Allow(51, now) {
+		t.Fatalf("bucket should have 50 tokens after 50ms")
+	}
+
+	// tokens never exceed burst
+	now += 10000
+	if !b.Allow(100, now) {
+		t.Fatalf("bucket should be full after idle")
+	}
+
+	b.Take(100, now)
+	if b.Allow(1, now) {
+		t.Fatalf("tokens exceed burst")
+	}
+
+	// packet larger than burst passes when bucket is full and leaves bucket in debt
+	now += 100
+	if !b.Allow(300, now) {
+		t.Fatalf("full bucket should allow packet larger than burst")
+	}
+
+	b.Take(300, now)
+	if d := b.Delay(100, now); d < 300 || d > 301 {
+		t.Fatalf("delay after debt: %v, want 300ms", d)
+	}
+
+	// lower rate keeps tokens under new burst
+	now += 1000
+	b.SetRate(100, 10, now)
+	if b.Rate() != 100 || !b.Allow(10, now) {
+		t.Fatalf("set rate invalid")
+	}
+
+	b.Take(10, now)
+	if b.Allow(1, now) {
+		t.Fatalf("tokens exceed new burst")
+	}
+
+	// burst defaults to rate
+	b = NewTokenBucket(500, 0, now)
+	if !b.Allow(500, now) {
+		t.Fatalf("burst should default to rate")
+	}
+
+	b.Take(500, now)
+	if b.Allow(1, now) {
+		t.Fatalf("default burst exceeds rate")
+	}
+
+	// clock going back doesn't add tokens
+	if b.Allow(1, now-100) {
+		t.Fatalf("clock going back adds tokens")
+	}
+}
+
+func TestBandwidthShares(t *testing.T) {
+	cases := []struct {
+		limit, active, idle int
+	}{
+		{10000, 1, 0},
+		{10000, 0, 5},
+		{10000, 1, 9},
+		{10000, 3, 100},
+		{10000, 10, 1000},
+		{100000, 7, 3},
+	}
+
+	for _, c := range cases {
+		activeShare, idleShare := bandwidthShares(c.limit, c.active, c.idle)
+		if activeShare <= 0 || (c.idle > 0 && idleShare <= 0) {
+			t.Fatalf("%+v: share is unlimited, active: %v, idle: %v", c, activeShare, idleShare)
+		}
+
+		if total := activeShare*c.active + idleShare*c.idle; total > c.limit {
+			t.Fatalf("%+v: total %v exceeds limit", c, total)
+		}
+
+		if c.active > 0 && c.idle > 0 && idleShare >= activeShare {
+			t.Fatalf("%+v: idle share %v not less than active share %v", c, idleShare, activeShare)
+		}
+	}
+
+	// active connections get the whole limit without idle connections
+	if activeShare, _ := bandwidthShares(9000, 3, 0); activeShare != 3000 {
+		t.Fatalf("active share: %v, want 3000", activeShare)
+	}
+
+	// idle connections share 1/10 of limit when someone is active
+	if activeShare, idleShare := bandwidthShares(10000, 1, 10); idleShare != 100 || activeShare != 9000 {
+		t.Fatalf("share with idle conns: %v, %v", activeShare, idleShare)
+	}
+
+	if activeShare, idleShare := bandwidthShares(0, 3, 3); activeShare != 0 || idleShare != 0 {
+		t.Fatalf("no limit should be unlimited share")
+	}
+}